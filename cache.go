@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kinds of cache entries
+const (
+	cacheSearch = "search"
+	cachePage   = "page"
+)
+
+// CacheEntry is a search or a fetched page saved to disk, so that it does not
+// have to be searched or fetched again until it expires
+type CacheEntry struct {
+	Kind string `json:"kind"`
+	// the query and options searched, or the URL of the page
+	Key     string         `json:"key"`
+	Time    time.Time      `json:"time"`
+	Results []SearchResult `json:"results,omitempty"`
+	// main text of the page
+	Text string `json:"text,omitempty"`
+}
+
+// directory where the cache is stored
+func cacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".waldo", "cache"), nil
+}
+
+// file for an entry, named by the hash of its kind and key
+func cacheFile(kind string, key string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(kind + "\n" + key))
+	return filepath.Join(dir, kind+"-"+hex.EncodeToString(hash[:16])+".json"), nil
+}
+
+// how long entries of the kind are kept, 0 if they are not cached
+func cacheTTL(kind string) time.Duration {
+	if kind == cacheSearch {
+		return cfg.Cache.Search
+	}
+	return cfg.Cache.Pages
+}
+
+// get an entry from the cache, returns false if it is not cached or has expired
+func cacheGet(kind string, key string) (*CacheEntry, bool) {
+	if cacheTTL(kind) <= 0 {
+		return nil, false
+	}
+	file, err := cacheFile(kind, key)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	entry := &CacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil || entry.Key != key || entry.Expired() {
+		return nil, false
+	}
+	return entry, true
+}
+
+// save an entry to the cache
+func cachePut(entry *CacheEntry) error {
+	if cacheTTL(entry.Kind) <= 0 {
+		return nil
+	}
+	file, err := cacheFile(entry.Kind, entry.Key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create cache directory %w", err)
+	}
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0o644)
+}
+
+// has the entry been kept longer than the time to live for its kind
+func (e *CacheEntry) Expired() bool {
+	return time.Since(e.Time) > cacheTTL(e.Kind)
+}
+
+// one line description of an entry
+func (e *CacheEntry) String() string {
+	age := time.Since(e.Time).Round(time.Minute)
+	status := ""
+	if e.Expired() {
+		status = ", expired"
+	}
+	return fmt.Sprintf("%-6s  %s (%s ago%s)", e.Kind, e.Key, age, status)
+}
+
+// list the entries in the cache, most recent first
+func listCache() ([]*CacheEntry, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := []*CacheEntry{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		entry := &CacheEntry{}
+		if json.Unmarshal(data, entry) != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// remove the entries in the cache that match, returns the number removed
+func purgeCache(match func(*CacheEntry) bool) (int, error) {
+	entries, err := listCache()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, entry := range entries {
+		if !match(entry) {
+			continue
+		}
+		file, err := cacheFile(entry.Kind, entry.Key)
+		if err != nil {
+			return n, err
+		}
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// key for a search, the engine, the query in lower case with the spaces
+// normalized and the filters
+func searchKey(engine string, query string, opts SearchOptions) string {
+	key := engine + ": " + strings.Join(strings.Fields(strings.ToLower(opts.Query(query))), " ")
+	if opts.Region != "" {
+		key += " region:" + strings.ToLower(opts.Region)
+	}
+	if opts.Time != "" {
+		key += " time:" + opts.Time
+	}
+	return key
+}
+
+// search using the engine, using the cached results unless the search is fresh
+func cachedSearch(c context.Context, e SearchEngine, query string, opts SearchOptions) ([]SearchResult, error) {
+	key := searchKey(e.Name(), query, opts)
+	if !opts.Fresh {
+		if entry, ok := cacheGet(cacheSearch, key); ok {
+			return entry.Results, nil
+		}
+	}
+	results, err := e.Search(c, query, opts)
+	if err != nil {
+		return results, err
+	}
+	err = cachePut(&CacheEntry{Kind: cacheSearch, Key: key, Results: results})
+	if err != nil {
+		fmt.Println("err in caching search:", err)
+	}
+	return results, nil
+}
+
+// fetch a page, using the cached text unless fresh is set
+func cachedPage(c context.Context, pageURL string, fresh bool) (string, error) {
+	if !fresh {
+		if entry, ok := cacheGet(cachePage, pageURL); ok {
+			return entry.Text, nil
+		}
+	}
+	text, err := fetchPage(c, pageURL)
+	if err != nil {
+		return text, err
+	}
+	err = cachePut(&CacheEntry{Kind: cachePage, Key: pageURL, Text: text})
+	if err != nil {
+		fmt.Println("err in caching page:", err)
+	}
+	return text, nil
+}
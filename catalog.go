@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ModelInfo describes a model, the provider that serves it and what it can do
+type ModelInfo struct {
+	Name     string `json:"name" yaml:"name"`
+	Provider string `json:"provider" yaml:"provider"`
+	// can answer questions on images
+	Vision bool `json:"vision" yaml:"vision"`
+	// can respond in JSON
+	JSON bool `json:"json" yaml:"json"`
+	// number of tokens in the context window
+	ContextWindow int `json:"context_window" yaml:"context_window"`
+	// default options for the model, e.g. temperature
+	Options map[string]any `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// ModelConfig declares a model in the config, fields that are not set keep
+// what the providers know about the model
+type ModelConfig struct {
+	Name     string `yaml:"name"`
+	Provider string `yaml:"provider"`
+	// can answer questions on images, false turns it off
+	Vision *bool `yaml:"vision"`
+	// can respond in JSON, false turns it off
+	JSON          *bool          `yaml:"json"`
+	ContextWindow int            `yaml:"context_window"`
+	Options       map[string]any `yaml:"options,omitempty"`
+}
+
+// context window assumed for models that do not declare one
+const defaultContextWindow = 2048
+
+// Catalog keeps the models from the providers and the config
+type Catalog struct {
+	mu     sync.Mutex
+	models map[string]ModelInfo
+}
+
+// the model catalog
+var catalog = &Catalog{models: map[string]ModelInfo{}}
+
+// list the models from all the providers, merged with the models declared
+// in the config
+func (c *Catalog) Refresh(ctx context.Context) ([]ModelInfo, error) {
+	models := map[string]ModelInfo{}
+	names := []string{}
+	for _, p := range append(providers, fallbackProvider) {
+		infos, err := p.Models(ctx)
+		if err != nil {
+			return []ModelInfo{}, err
+		}
+		for _, info := range infos {
+			if _, ok := models[info.Name]; !ok {
+				names = append(names, info.Name)
+			}
+			models[info.Name] = info
+		}
+	}
+	// models only declared in the config are listed after the others
+	declared := []string{}
+	for _, m := range cfg.Models {
+		if _, ok := models[m.Name]; !ok {
+			declared = append(declared, m.Name)
+		}
+		models[m.Name] = mergeModelInfo(models[m.Name], m)
+	}
+	sort.Strings(declared)
+	names = append(names, declared...)
+
+	c.mu.Lock()
+	c.models = models
+	c.mu.Unlock()
+
+	results := []ModelInfo{}
+	for _, name := range names {
+		results = append(results, models[name])
+	}
+	return results, nil
+}
+
+// look up a model, models that are not in the catalog are looked up in the
+// config, the providers with fixed lists of models and then Ollama
+func (c *Catalog) Lookup(ctx context.Context, name string) ModelInfo {
+	c.mu.Lock()
+	info, ok := c.models[name]
+	c.mu.Unlock()
+	if ok {
+		return info
+	}
+
+	info = ModelInfo{Name: name}
+	found := false
+	for _, p := range providers {
+		infos, err := p.Models(ctx)
+		if err != nil {
+			continue
+		}
+		for _, i := range infos {
+			if i.Name == name {
+				info, found = i, true
+			}
+		}
+	}
+	var declared *ModelConfig
+	for i := range cfg.Models {
+		if cfg.Models[i].Name == name {
+			declared = &cfg.Models[i]
+		}
+	}
+	// models the other providers do not know are asked from Ollama
+	if !found && (declared == nil || declared.Provider == "" || declared.Provider == fallbackProvider.Name()) {
+		if shown, err := ollamaShow(ctx, name); err == nil {
+			info = shown
+		}
+	}
+	if declared != nil {
+		info = mergeModelInfo(info, *declared)
+	}
+	if info.Provider == "" {
+		info.Provider = fallbackProvider.Name()
+	}
+	if info.ContextWindow == 0 {
+		info.ContextWindow = defaultContextWindow
+	}
+	// unknown models are kept too, so they are only checked again after a refresh
+	c.mu.Lock()
+	c.models[name] = info
+	c.mu.Unlock()
+	return info
+}
+
+// overlay the fields set in the config on the model info
+func mergeModelInfo(info ModelInfo, override ModelConfig) ModelInfo {
+	info.Name = override.Name
+	if override.Provider != "" {
+		info.Provider = override.Provider
+	}
+	if override.Vision != nil {
+		info.Vision = *override.Vision
+	}
+	if override.JSON != nil {
+		info.JSON = *override.JSON
+	}
+	if override.ContextWindow != 0 {
+		info.ContextWindow = override.ContextWindow
+	}
+	if len(override.Options) > 0 {
+		options := map[string]any{}
+		for k, v := range info.Options {
+			options[k] = v
+		}
+		for k, v := range override.Options {
+			options[k] = v
+		}
+		info.Options = options
+	}
+	return info
+}
+
+// description of the model and what it can do, for listing models
+func (m ModelInfo) String() string {
+	features := []string{m.Provider}
+	if m.Vision {
+		features = append(features, "vision")
+	}
+	if m.JSON {
+		features = append(features, "json")
+	}
+	if m.ContextWindow != 0 {
+		features = append(features, fmt.Sprintf("%dk context", m.ContextWindow/1024))
+	}
+	return fmt.Sprintf("%s (%s)", m.Name, strings.Join(features, ", "))
+}
+
+// get a number option for the model
+func (m ModelInfo) Float(option string) (float64, bool) {
+	switch v := m.Options[option].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// get the model's details from Ollama, waiting at most the request timeout
+func ollamaShow(c context.Context, name string) (ModelInfo, error) {
+	reqJson, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	if cfg.Timeouts.Request > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, cfg.Timeouts.Request)
+		defer cancel()
+	}
+	httpResp, err := postOllama(c, "/api/show", reqJson)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != 200 {
+		return ModelInfo{}, fmt.Errorf("cannot show model %s, status is %d", name, httpResp.StatusCode)
+	}
+	resp := &ShowResponse{}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return ModelInfo{}, err
+	}
+
+	info := ModelInfo{
+		Name:          name,
+		Provider:      fallbackProvider.Name(),
+		JSON:          true,
+		ContextWindow: defaultContextWindow,
+	}
+	// multi-modal models like llava have a clip projector
+	for _, family := range append(resp.Details.Families, resp.Details.Family) {
+		if family == "clip" {
+			info.Vision = true
+		}
+	}
+	// parameters are given one per line, e.g. num_ctx 4096
+	scanner := bufio.NewScanner(strings.NewReader(resp.Parameters))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				info.ContextWindow = n
+			}
+		}
+	}
+	return info, nil
+}
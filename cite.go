@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Citations checks the numbered citations in an answer against the sources
+// given to the model
+type Citations struct {
+	// sources, cited as [1] for the first one
+	Sources []SearchResult
+	// numbers of the sources that are cited, in order
+	Cited []int
+	// numbers that are cited but are not a source
+	Invalid []int
+	// sentences that do not cite a source
+	Uncited []string
+}
+
+// a citation like [1] or [1, 3]
+var citationPattern = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// the end of a sentence, a full stop followed by a space or the end of the
+// line, with any citations after the full stop
+var sentenceEnd = regexp.MustCompile(`[.!?]+(?:\s*\[[\d,\s]+\])*(?:\s+|$)`)
+
+// abbreviations like e.g. and U.S. that do not end a sentence
+var abbreviation = regexp.MustCompile(`(?:^|\s)(?:\pL\.)+$|(?:^|\s)(?i:mr|mrs|ms|dr|st|vs|no|approx)\.$`)
+
+// sentences shorter than this are not checked, e.g. list items
+const minSentenceWords = 4
+
+// find the sources cited in the answer and the sentences that cite nothing
+func checkCitations(answer string, sources []SearchResult) Citations {
+	c := Citations{Sources: sources}
+	cited := map[int]bool{}
+	invalid := map[int]bool{}
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, field := range strings.Split(match[1], ",") {
+			n, _ := strconv.Atoi(strings.TrimSpace(field))
+			if n < 1 || n > len(sources) {
+				invalid[n] = true
+			} else {
+				cited[n] = true
+			}
+		}
+	}
+	c.Cited = sortedKeys(cited)
+	c.Invalid = sortedKeys(invalid)
+
+	for _, line := range strings.Split(answer, "\n") {
+		line = strings.TrimSpace(line)
+		// headings and lines introducing a list are not claims
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasSuffix(line, ":") {
+			continue
+		}
+		for _, sentence := range sentences(line) {
+			sentence = strings.TrimSpace(strings.TrimLeft(sentence, "*-0123456789. "))
+			if len(strings.Fields(sentence)) < minSentenceWords {
+				continue
+			}
+			if !citationPattern.MatchString(sentence) {
+				c.Uncited = append(c.Uncited, sentence)
+			}
+		}
+	}
+	return c
+}
+
+// split the line into sentences, full stops in numbers like 5.6, in
+// abbreviations and before words in lower case do not end a sentence
+func sentences(line string) []string {
+	results := []string{}
+	start := 0
+	for _, loc := range sentenceEnd.FindAllStringIndex(line, -1) {
+		if loc[1] < len(line) {
+			next, _ := utf8.DecodeRuneInString(line[loc[1]:])
+			if unicode.IsLower(next) || abbreviation.MatchString(line[:loc[0]+1]) {
+				continue
+			}
+		}
+		results = append(results, line[start:loc[1]])
+		start = loc[1]
+	}
+	if start < len(line) {
+		results = append(results, line[start:])
+	}
+	return results
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := []int{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// the footer listing the sources cited, and the sentences that cite nothing
+func (c Citations) Footer() string {
+	footer := ""
+	if len(c.Cited) > 0 {
+		footer += "\n\nSources:\n"
+		for _, n := range c.Cited {
+			source := c.Sources[n-1]
+			footer += fmt.Sprintf("[%d] %s\n    %s\n", n, strings.TrimSpace(source.Title), source.Url)
+		}
+	}
+	if len(c.Invalid) > 0 {
+		numbers := []string{}
+		for _, n := range c.Invalid {
+			numbers = append(numbers, fmt.Sprintf("[%d]", n))
+		}
+		footer += fmt.Sprintf("\nNot a source: %s\n", strings.Join(numbers, ", "))
+	}
+	if len(c.Uncited) > 0 {
+		footer += "\nNot supported by a source:\n"
+		for _, sentence := range c.Uncited {
+			footer += "- " + sentence + "\n"
+		}
+	}
+	return footer
+}
+
+// citeSink holds back the end of the answer so that the sources can be
+// added to it
+type citeSink struct {
+	Sink
+	stats Stats
+}
+
+func (s *citeSink) Done(stats Stats) {
+	s.stats = stats
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// exit codes for the one-shot commands
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitCancelled = 130
+)
+
+const usage = `Usage:
+  waldo [-config file] [-model model] [-ollama-host host:port] [-profile profile] [command]
+
+Commands:
+  (none)                              start the interactive shell
+  waldo ask [-m model] [-f file ...] "question"
+                                      ask a question, about the documents attached
+  waldo search [-m model] [search options] "query"
+                                      search the Internet
+  waldo research [-m model] [search options] [-o file] "question"
+                                      research a question and write a report
+  waldo do [-m model] [-y] "task"    propose a shell command for the task and run it
+  waldo index directory               index the documents in a directory
+  waldo docs [-m model] [-path path] [-type type] [-tag tag ...] "question"
+                                      ask a question on the indexed documents
+  waldo image [-m model] -f file ... "question"
+                                      ask a question about one or more image files
+  waldo models                        list the available models
+  waldo serve [-m model] [-addr host:port]
+                                      serve waldo as JSON endpoints over HTTP
+
+Search options:
+  -engine engine     search engine to use, e.g. searxng
+  -rewrite           rewrite the question into keyword queries
+  -site site         only search this site, e.g. gov.sg
+  -filetype type     only search for files of this type, e.g. pdf
+  -region region     country to search in, e.g. sg or de-de
+  -time range        only search pages from the past day, week, month or year
+  -fresh             do not use the cached search results and pages
+`
+
+// files is a flag that can be given more than once
+type files []string
+
+func (f *files) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *files) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// run a command once without the interactive shell, returns the exit code
+func runOnce(args []string) int {
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return exitOK
+	}
+	flags := flag.NewFlagSet("waldo "+args[0], flag.ContinueOnError)
+	flags.StringVar(&model, "m", model, "model to use")
+	inputFiles := files{}
+	switch args[0] {
+	case "image":
+		flags.Var(&inputFiles, "f", "image file, can be given more than once")
+	case "ask":
+		flags.Var(&inputFiles, "f", "document file to attach, can be given more than once")
+	}
+	opts, report := SearchOptions{}, ""
+	if args[0] == "search" || args[0] == "research" {
+		opts.AddFlags(flags)
+	}
+	filter := Filter{}
+	if args[0] == "docs" {
+		filter.AddFlags(flags)
+	}
+	if args[0] == "research" {
+		flags.StringVar(&report, "o", "", "save the report as markdown to the file")
+	}
+	yes := false
+	if args[0] == "do" {
+		flags.BoolVar(&yes, "y", false, "run the command without asking")
+	}
+	addr := "localhost:9090"
+	if args[0] == "serve" {
+		flags.StringVar(&addr, "addr", addr, "address to serve on")
+	}
+	if flags.Parse(args[1:]) != nil {
+		return exitUsage
+	}
+	query := strings.Join(flags.Args(), " ")
+
+	// only the answer goes to stdout so that it can be piped
+	out := &WriterSink{W: os.Stdout}
+	ctx, stop := interruptible()
+	defer stop()
+	var err error
+	switch args[0] {
+	case "ask":
+		if query == "" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = waitForProvider(ctx, model)
+		if err == nil {
+			_, err = ask(ctx, out, newSession(), model, query, inputFiles, nil)
+		}
+	case "search":
+		if query == "" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = waitForProvider(ctx, model)
+		if err == nil {
+			_, err = search(ctx, out, model, query, opts)
+		}
+	case "research":
+		if query == "" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = waitForProvider(ctx, model)
+		if err == nil {
+			var r *Research
+			r, err = research(ctx, out, model, query, opts, func(status string) {
+				fmt.Fprintln(os.Stderr, cyan("("+status+")"))
+			})
+			if err == nil && report != "" {
+				err = r.Save(report)
+			}
+		}
+	case "do":
+		if query == "" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = waitForProvider(ctx, model)
+		if err == nil {
+			err = doTask(ctx, model, query, yes)
+		}
+	case "index":
+		if query == "" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = waitForOllama()
+		if err == nil {
+			var store *VectorStore
+			var stats UpdateStats
+			store, stats, err = indexDocs(ctx, query, func(file string) {
+				fmt.Fprintln(os.Stderr, cyan("(indexing "+file+")"))
+			})
+			if err == nil {
+				fmt.Printf("%s, %d chunks in %d documents indexed\n", stats, store.Len(), len(store.Documents))
+			}
+		}
+	case "docs":
+		if query == "" {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		err = waitForOllama()
+		if err == nil {
+			_, err = docs(ctx, out, model, query, filter)
+		}
+	case "image":
+		if query == "" || len(inputFiles) == 0 {
+			fmt.Fprint(os.Stderr, usage)
+			return exitUsage
+		}
+		// the model is looked up in Ollama, so wait for it to start first
+		err = waitForProvider(ctx, model)
+		if err == nil && !isImageModel(ctx) {
+			fmt.Fprintln(os.Stderr, red(model+" cannot answer questions on images, use an image model like llava or Gemini-Pro-Vision or GPT-4-Vision."))
+			return exitUsage
+		}
+		if err == nil {
+			_, err = askImage(ctx, out, newSession(), model, query, inputFiles)
+		}
+	case "models":
+		err = waitForOllama()
+		if err == nil {
+			var models []string
+			models, err = getModels(ctx)
+			for _, m := range models {
+				fmt.Println(m)
+			}
+		}
+	case "serve":
+		err = serve(addr)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, cyan("\n(cancelled)"))
+		return exitCancelled
+	}
+	// the exit status of a command run by do has already been reported
+	if status, ok := interp.IsExitStatus(err); ok {
+		return int(status)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, red(err))
+		return exitError
+	}
+	return exitOK
+}
+
+// propose a command for the task and run it if the user confirms, the
+// proposal goes to stderr and the output of the command to stdout
+func doTask(c context.Context, model string, task string, yes bool) error {
+	resp, err := proposeCommand(c, model, task)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, resp.Describe())
+	err = resp.Check()
+	if err != nil {
+		return err
+	}
+	// the shell policy can still want the command confirmed if it is run
+	// without asking
+	confirm := confirmStdin
+	if !yes {
+		if !confirmStdin(resp.Command) {
+			return fmt.Errorf("command not run")
+		}
+		confirm = func(string) bool { return true }
+	}
+	_, err = runCommand(c, resp, confirm, os.Stdout, os.Stderr)
+	return err
+}
+
+// ask the user to confirm a command on stderr, reading the answer from stdin
+func confirmStdin(line string) bool {
+	fmt.Fprint(os.Stderr, green(line)+cyan(" run this command? [y/N] "))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return confirmed(answer)
+}
+
+// wait for the embedded Ollama server if the model is served by Ollama
+func waitForProvider(c context.Context, model string) error {
+	if getProvider(c, model) != fallbackProvider {
+		return nil
+	}
+	return waitForOllama()
+}
+
+// wait for the embedded Ollama server to start accepting requests
+func waitForOllama() error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(cfg.ollamaURL())
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ollama server is not running: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// how risky a proposed command is to run
+const (
+	riskLow    = "low"
+	riskMedium = "medium"
+	riskHigh   = "high"
+)
+
+// lines at the end of the output of a failed command given to the model to
+// diagnose it
+const diagnoseLines = 50
+
+// ask the model for a shell command that does the task, the command is only
+// proposed and not run
+func proposeCommand(c context.Context, model string, task string) (*CommandResponse, error) {
+	ctx, err := json.MarshalIndent(struct {
+		Task      string `json:"task"`
+		OS        string `json:"os"`
+		Shell     string `json:"shell"`
+		Directory string `json:"directory"`
+	}{task, runtime.GOOS, "bash", shellDir()}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := commandResponse(c, model, cfg.Prompts.Command, string(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Command == "" {
+		return nil, fmt.Errorf("%s did not propose a command for the task", model)
+	}
+	return resp, nil
+}
+
+// ask the model why the command failed, with the exit status and the end of
+// its output, and for a command that fixes it. The command is empty if the
+// model cannot suggest one.
+func diagnoseCommand(c context.Context, model string, line string, status uint8, output []byte) (*CommandResponse, error) {
+	ctx, err := json.MarshalIndent(struct {
+		Command    string `json:"command"`
+		ExitStatus uint8  `json:"exit_status"`
+		Output     string `json:"output"`
+		OS         string `json:"os"`
+		Shell      string `json:"shell"`
+		Directory  string `json:"directory"`
+	}{line, status, lastLines(string(output), diagnoseLines), runtime.GOOS, "bash", shellDir()}, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return commandResponse(c, model, cfg.Prompts.Diagnose, string(ctx))
+}
+
+// get a command from the model, responding in JSON
+func commandResponse(c context.Context, model string, prompt string, ctx string) (*CommandResponse, error) {
+	answer, err := predict(c, &FuncSink{}, model, prompt, ctx, "json")
+	if err != nil {
+		return nil, err
+	}
+	resp := &CommandResponse{}
+	err = json.Unmarshal([]byte(answer), resp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the command proposed by %s: %w", model, err)
+	}
+	resp.Command = strings.TrimSpace(resp.Command)
+	// a command that is not rated is taken as risky
+	resp.Risk = strings.ToLower(strings.TrimSpace(resp.Risk))
+	if resp.Risk != riskLow && resp.Risk != riskMedium {
+		resp.Risk = riskHigh
+	}
+	return resp, nil
+}
+
+// the last n lines of the text
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the working directory of the shell, commands are run there
+func shellDir() string {
+	if sh != nil {
+		return sh.Dir()
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// the proposed command with what it does, for the user to confirm
+func (r *CommandResponse) Describe() string {
+	risk := green(r.Risk)
+	switch r.Risk {
+	case riskMedium:
+		risk = yellow(r.Risk)
+	case riskHigh:
+		risk = red(r.Risk)
+	}
+	desc := green(r.Command) + "\n"
+	if r.Explanation != "" {
+		desc += strings.TrimSpace(r.Explanation) + "\n"
+	}
+	if len(r.Inputs) > 0 {
+		desc += cyan("inputs: ") + strings.Join(r.Inputs, ", ") + "\n"
+	}
+	if len(r.Outputs) > 0 {
+		desc += cyan("outputs: ") + strings.Join(r.Outputs, ", ") + "\n"
+	}
+	return desc + cyan("risk: ") + risk + "\n"
+}
+
+// is the answer to a confirmation a yes
+func confirmed(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// check the proposed command against the policy of the shell profile
+func (r *CommandResponse) Check() error {
+	policy, err := commandPolicy()
+	if err != nil {
+		return err
+	}
+	_, err = policy.Check(r.Command)
+	return err
+}
+
+// run the proposed command in the shell
+func runCommand(c context.Context, r *CommandResponse, confirm func(string) bool, stdout io.Writer, stderr io.Writer) ([]byte, error) {
+	return run(c, r.Command, confirm, stdout, stderr)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings for waldo. Settings are layered, each layer
+// overriding the one before it: the defaults, the user config file in
+// ~/.config/waldo/config.yaml, the project config file waldo.yaml in the
+// current directory, environment variables and finally command line flags.
+type Config struct {
+	Model    string         `yaml:"model"`
+	Ollama   OllamaConfig   `yaml:"ollama"`
+	OpenAI   OpenAIConfig   `yaml:"openai"`
+	Gemini   GeminiConfig   `yaml:"gemini"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	Search   SearchConfig   `yaml:"search"`
+	Research ResearchConfig `yaml:"research"`
+	Cache    CacheConfig    `yaml:"cache"`
+	Docs     DocsConfig     `yaml:"docs"`
+	Shell    ShellConfig    `yaml:"shell"`
+	Prompts  PromptsConfig  `yaml:"prompts"`
+	// models to add to the catalog, or to override what is known about them
+	Models []ModelConfig `yaml:"models"`
+	// settings changed with Set, saved with the user config file
+	changed []string
+}
+
+type OllamaConfig struct {
+	// host and port of the embedded Ollama server
+	Host string `yaml:"host"`
+}
+
+type OpenAIConfig struct {
+	APIKey  string `yaml:"api_key"`
+	BaseURL string `yaml:"base_url"`
+}
+
+type GeminiConfig struct {
+	APIKey string `yaml:"api_key"`
+}
+
+type TimeoutsConfig struct {
+	// timeout for requests that are not streamed, like searches
+	Request time.Duration `yaml:"request"`
+	// maximum time for the model to generate an answer, 0 for no limit
+	Generate time.Duration `yaml:"generate"`
+	// maximum time for a shell command to run, 0 for no limit
+	Command time.Duration `yaml:"command"`
+}
+
+type SearchConfig struct {
+	// search engine to use, one of duckduckgo, searxng, brave, bing or fixture
+	Engine string `yaml:"engine"`
+	// rewrite questions into keyword queries before searching
+	Rewrite bool `yaml:"rewrite"`
+	// number of search results to use
+	Results int `yaml:"results"`
+	// number of pages behind the top search results to read, 0 to only use
+	// the titles and descriptions of the results
+	Pages     int           `yaml:"pages"`
+	UserAgent string        `yaml:"user_agent"`
+	SearXNG   SearXNGConfig `yaml:"searxng"`
+	Brave     APIKeyConfig  `yaml:"brave"`
+	Bing      APIKeyConfig  `yaml:"bing"`
+	Fixture   FixtureConfig `yaml:"fixture"`
+}
+
+type SearXNGConfig struct {
+	// URL of the SearXNG instance, e.g. http://localhost:8080
+	URL string `yaml:"url"`
+}
+
+type APIKeyConfig struct {
+	APIKey string `yaml:"api_key"`
+}
+
+type FixtureConfig struct {
+	// JSON file of queries to search results
+	File string `yaml:"file"`
+}
+
+type ResearchConfig struct {
+	// most rounds of searching before writing the report
+	Rounds int `yaml:"rounds"`
+	// most queries searched in each round
+	Queries int `yaml:"queries"`
+	// most search results used in the report
+	Sources int `yaml:"sources"`
+}
+
+type CacheConfig struct {
+	// how long search results are cached, 0 to not cache them
+	Search time.Duration `yaml:"search"`
+	// how long fetched pages are cached, 0 to not cache them
+	Pages time.Duration `yaml:"pages"`
+}
+
+type DocsConfig struct {
+	// Ollama model used to embed the documents
+	EmbedModel string `yaml:"embed_model"`
+	// number of characters in each chunk of a document
+	ChunkSize int `yaml:"chunk_size"`
+	// number of chunks used to answer a question
+	Results int `yaml:"results"`
+}
+
+type ShellConfig struct {
+	// profile with the policy for running commands, one of default, strict,
+	// dry-run or a profile added to profiles
+	Profile  string                   `yaml:"profile"`
+	Profiles map[string]CommandPolicy `yaml:"profiles"`
+	// ask the model why a command failed and for a command that fixes it
+	Diagnose bool `yaml:"diagnose"`
+}
+
+type PromptsConfig struct {
+	Ask    string `yaml:"ask"`
+	Search string `yaml:"search"`
+	Image  string `yaml:"image"`
+	// prompt to answer questions on the files attached to a question
+	Files string `yaml:"files"`
+	// prompt to answer questions on the output of a shell command
+	Output string `yaml:"output"`
+	// prompt to answer questions on the indexed documents
+	Docs string `yaml:"docs"`
+	// prompt to turn a task into a shell command
+	Command string `yaml:"command"`
+	// prompt to explain why a shell command failed and fix it
+	Diagnose string `yaml:"diagnose"`
+	// prompt to rewrite questions into search engine queries
+	Rewrite string `yaml:"rewrite"`
+	// prompts for research, to plan the queries, review the results and
+	// write the report
+	Plan   string `yaml:"plan"`
+	Review string `yaml:"review"`
+	Report string `yaml:"report"`
+}
+
+// the current configuration
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Ollama: OllamaConfig{
+			Host: "127.0.0.1:11435",
+		},
+		Timeouts: TimeoutsConfig{
+			Request: 30 * time.Second,
+		},
+		Search: SearchConfig{
+			Engine:    "duckduckgo",
+			Results:   5,
+			Pages:     3,
+			UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+		},
+		Research: ResearchConfig{
+			Rounds:  3,
+			Queries: 3,
+			Sources: 12,
+		},
+		Cache: CacheConfig{
+			Search: 24 * time.Hour,
+			Pages:  7 * 24 * time.Hour,
+		},
+		Docs: DocsConfig{
+			EmbedModel: "nomic-embed-text",
+			ChunkSize:  1000,
+			Results:    5,
+		},
+		Shell: ShellConfig{
+			Profile:  "default",
+			Profiles: defaultProfiles(),
+		},
+		Prompts: PromptsConfig{
+			Ask: `Give immediate, precise and clear answers to questions asked. If you do not know
+the answer, say "I don't know the answer to this.".
+`,
+			Search: `The following search results has come back from a search engine given the query
+that came from a user. Respond to the original query using the search results. Do not add any
+additional information. Assume the person you are explaining to doesn't know anything about
+the answer and provide a detailed response based on the query results only. Each search result
+is numbered, cite the search results that support each sentence with their numbers in square
+brackets at the end of the sentence, e.g. [1] or [2, 3]. Do not end the response with a list
+of the search results or their URLs.`,
+			Image: `Answer the question about a given image. Provide clear details in paragraph form, do not answer in point form or with numbered bullets. Only answer what you know, do not add any additional details that you do not have the answer to.`,
+			Files: `Answer the question using the following documents. Each part of a document starts with
+the name of the document, and the page or section if it has them, in square brackets. Cite the
+documents that support each sentence in the same way at the end of the sentence, e.g.
+[report.pdf, page 3].`,
+			Output: `Answer the question using the following output of a shell command. The command is given
+after the $, followed by its output and its exit status. Long output has lines left out in the
+middle. Quote the lines of the output that the answer is based on.`,
+			Docs: `Answer the question using the given parts of documents only. If the documents do not have
+the answer, say "I don't know the answer to this.". Each part is numbered, cite the parts that support
+each sentence with their numbers in square brackets at the end of the sentence, e.g. [1] or [2, 3].
+Do not end the answer with a list of the documents.`,
+			Command: `You are an expert in the command line. Given a task, the operating system, the shell and
+the current directory, write a single shell command that does the task. Prefer commands that do not
+change or delete anything unless the task asks for it. Respond in JSON with the files or values the
+command reads as inputs, the command, the files or values it produces as outputs, a short explanation
+of what the command does, and how risky it is to run, low, medium or high, e.g.
+{"inputs": ["*.log"], "command": "grep -c error *.log", "outputs": ["count of errors in each file"],
+"explanation": "Counts the lines with error in each log file.", "risk": "low"}. A command that
+deletes or overwrites files, changes the system or needs sudo is high risk.`,
+			Diagnose: `You are an expert in the command line. A shell command failed. Given the command, its
+exit status, the end of its output, the operating system, the shell and the current directory,
+explain briefly why it failed and write a single shell command that does what the failed command
+was meant to do. Respond in JSON with the explanation, the corrected command and how risky it is to
+run, low, medium or high, e.g. {"explanation": "There is no file called main.og, it is main.go.",
+"command": "go run main.go", "risk": "low"}. If the command cannot be fixed with another command,
+respond with an empty command and explain what to do instead. A command that deletes or overwrites
+files, changes the system or needs sudo is high risk.`,
+			Rewrite: `Rewrite the question into one to three short keyword queries for an Internet search
+engine that will find the pages that answer the question. Leave out words that do not help the
+search. Respond in JSON with the queries, e.g. {"queries": ["query 1", "query 2"]}.`,
+			Plan: `You are planning research to answer a question using an Internet search engine. Break
+the question down into the sub-questions that need to be answered, and give a short search engine
+query for each of them. Respond in JSON with the queries, e.g. {"queries": ["query 1", "query 2"]}.`,
+			Review: `You are researching a question using an Internet search engine. Given the question, the
+queries searched so far and the search results, decide if the search results are enough to answer
+the question fully. If they are, respond in JSON with {"done": true}. If not, respond with new search
+engine queries for what is missing, e.g. {"done": false, "queries": ["query 1", "query 2"]}.`,
+			Report: `Write a detailed, long-form report that answers the question using the search results only.
+Organise the report into sections with markdown headings, starting with a summary of the answer. Do
+not add any additional information. Each search result is numbered, cite the search results that
+support each sentence with their numbers in square brackets at the end of the sentence, e.g. [1] or
+[2, 3]. Do not end the report with a list of the search results or their URLs.`,
+		},
+	}
+}
+
+// path of the user config file
+func userConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "waldo", "config.yaml"), nil
+}
+
+// load the configuration from the config files and environment variables,
+// file is an additional config file given on the command line
+func loadConfig(file string) (*Config, error) {
+	c := defaultConfig()
+	files := []string{}
+	if path, err := userConfigPath(); err == nil {
+		files = append(files, path)
+	}
+	files = append(files, "waldo.yaml")
+	for _, path := range files {
+		err := c.loadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return c, err
+		}
+	}
+	if file != "" {
+		err := c.loadFile(file)
+		if err != nil {
+			return c, err
+		}
+	}
+	c.loadEnv()
+	return c, nil
+}
+
+// overlay the settings in a config file
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal(data, c)
+	if err != nil {
+		return fmt.Errorf("cannot read config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// overlay the settings from environment variables
+func (c *Config) loadEnv() {
+	if v := os.Getenv("MODEL"); v != "" {
+		c.Model = v
+	}
+	if v := os.Getenv("OLLAMA_HOST"); v != "" {
+		c.Ollama.Host = v
+	}
+	if v := os.Getenv("OPENAI_API_KEY"); v != "" {
+		c.OpenAI.APIKey = v
+	}
+	if v := os.Getenv("OPENAI_BASE_URL"); v != "" {
+		c.OpenAI.BaseURL = v
+	}
+	if v := os.Getenv("GOOGLEAI_API_KEY"); v != "" {
+		c.Gemini.APIKey = v
+	}
+	if v := os.Getenv("SEARXNG_URL"); v != "" {
+		c.Search.SearXNG.URL = v
+	}
+	if v := os.Getenv("BRAVE_API_KEY"); v != "" {
+		c.Search.Brave.APIKey = v
+	}
+	if v := os.Getenv("BING_API_KEY"); v != "" {
+		c.Search.Bing.APIKey = v
+	}
+}
+
+// save the settings changed with Set to the user config file, keeping the
+// settings already in it. The defaults, the project config file and the
+// environment variables are not saved.
+func (c *Config) Save() (string, error) {
+	path, err := userConfigPath()
+	if err != nil {
+		return "", err
+	}
+	user := map[string]any{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	err = yaml.Unmarshal(data, &user)
+	if err != nil {
+		return "", fmt.Errorf("cannot read config file %s: %w", path, err)
+	}
+	if user == nil {
+		user = map[string]any{}
+	}
+	for _, key := range c.changed {
+		v, err := c.field(key)
+		if err != nil {
+			return "", err
+		}
+		value := v.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		setKey(user, strings.Split(key, "."), value)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return "", fmt.Errorf("could not create config directory %w", err)
+	}
+	data, err = yaml.Marshal(user)
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// set the value of a dotted key in the settings read from a config file
+func setKey(settings map[string]any, keys []string, value any) {
+	if len(keys) == 1 {
+		settings[keys[0]] = value
+		return
+	}
+	group, ok := settings[keys[0]].(map[string]any)
+	if !ok {
+		group = map[string]any{}
+		settings[keys[0]] = group
+	}
+	setKey(group, keys[1:], value)
+}
+
+// the configuration as YAML, with the API keys masked
+func (c *Config) String() string {
+	masked := *c
+	masked.OpenAI.APIKey = mask(c.OpenAI.APIKey)
+	masked.Gemini.APIKey = mask(c.Gemini.APIKey)
+	masked.Search.Brave.APIKey = mask(c.Search.Brave.APIKey)
+	masked.Search.Bing.APIKey = mask(c.Search.Bing.APIKey)
+	data, _ := yaml.Marshal(masked)
+	return string(data)
+}
+
+func mask(key string) string {
+	if len(key) <= 4 {
+		return strings.Repeat("*", len(key))
+	}
+	return "****" + key[len(key)-4:]
+}
+
+// host and port of the embedded Ollama server, defaults to port 11435 if
+// only the host is given
+func (c *Config) ollamaAddr() (string, string) {
+	host, port, err := net.SplitHostPort(c.Ollama.Host)
+	if err != nil {
+		host, port = strings.Trim(c.Ollama.Host, "[]"), "11435"
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+	}
+	return host, port
+}
+
+// URL to call the embedded Ollama server
+func (c *Config) ollamaURL() string {
+	host, port := c.ollamaAddr()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// get a setting using its dotted YAML key, e.g. search.results
+func (c *Config) Get(key string) (string, error) {
+	v, err := c.field(key)
+	if err != nil {
+		return "", err
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String(), nil
+	}
+	return fmt.Sprint(v.Interface()), nil
+}
+
+// set a setting using its dotted YAML key, e.g. search.results
+func (c *Config) Set(key string, value string) error {
+	v, err := c.field(key)
+	if err != nil {
+		return err
+	}
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(value)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s: %w", key, err)
+		}
+		v.SetInt(int64(d))
+	case int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number: %w", key, err)
+		}
+		v.SetInt(int64(i))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false: %w", key, err)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("%s cannot be set", key)
+	}
+	if !contains(c.changed, key) {
+		c.changed = append(c.changed, key)
+	}
+	return nil
+}
+
+// find the field for a dotted YAML key
+func (c *Config) field(key string) (reflect.Value, error) {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("no such setting %s", key)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0] == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("no such setting %s", key)
+		}
+	}
+	if v.Kind() == reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("%s is a group of settings", key)
+	}
+	return v, nil
+}
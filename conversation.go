@@ -0,0 +1,12 @@
+package main
+
+// Conversation keeps the turns between the user and the model so that
+// follow up questions have the context of the earlier ones
+type Conversation struct {
+	Messages []Message
+}
+
+// add a turn to the conversation
+func (c *Conversation) Add(role string, content string) {
+	c.Messages = append(c.Messages, Message{Role: role, Content: content})
+}
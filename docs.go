@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Chunk is a part of a document that is embedded and retrieved
+type Chunk struct {
+	// section of the document the chunk is in, e.g. page 3, empty if the
+	// document has no sections
+	Section string `json:"section,omitempty"`
+	// lines of the document, or of the section, in the chunk, starting from 1
+	StartLine int       `json:"start_line"`
+	EndLine   int       `json:"end_line"`
+	Text      string    `json:"text"`
+	Vector    []float64 `json:"vector"`
+}
+
+// files that are indexed
+var documentTypes = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".txt":      true,
+	".go":       true,
+	".html":     true,
+	".htm":      true,
+	".pdf":      true,
+	".docx":     true,
+	".epub":     true,
+}
+
+// lines shared by neighbouring chunks, so that text is not cut off at the
+// edge of a chunk
+const chunkOverlap = 2
+
+// index the documents in the directory, reporting each document embedded to
+// status
+func indexDocs(c context.Context, root string, status func(string)) (*VectorStore, UpdateStats, error) {
+	store, err := openStore()
+	if err != nil {
+		return nil, UpdateStats{}, err
+	}
+	stats, err := store.Update(c, root, status)
+	return store, stats, err
+}
+
+// read the sections of a document and its tags, the tags are given in the
+// front matter of markdown files, e.g. tags: [work, ideas]
+func readDocument(path string, data []byte) ([]Section, []string, error) {
+	sections, err := extractDocument(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return sections, frontMatterTags(string(data)), nil
+	}
+	return sections, []string{}, nil
+}
+
+// get the tags from the YAML front matter at the start of the text
+func frontMatterTags(text string) []string {
+	if !strings.HasPrefix(text, "---\n") {
+		return []string{}
+	}
+	end := strings.Index(text[4:], "\n---")
+	if end < 0 {
+		return []string{}
+	}
+	matter := struct {
+		Tags any `yaml:"tags"`
+	}{}
+	if yaml.Unmarshal([]byte(text[4:4+end]), &matter) != nil {
+		return []string{}
+	}
+	tags := []string{}
+	switch t := matter.Tags.(type) {
+	case string:
+		for _, tag := range strings.Split(t, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	case []any:
+		for _, tag := range t {
+			tags = append(tags, fmt.Sprint(tag))
+		}
+	}
+	return tags
+}
+
+// split the sections into chunks of whole lines of about size characters
+func chunkSections(sections []Section, size int) []Chunk {
+	chunks := []Chunk{}
+	for _, section := range sections {
+		for _, chunk := range chunkText(section.Text, size) {
+			chunk.Section = section.Name
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// split the text into chunks of whole lines of about size characters
+func chunkText(text string, size int) []Chunk {
+	lines := strings.Split(strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+	chunks := []Chunk{}
+	for start := 0; start < len(lines); {
+		end, length := start, 0
+		for end < len(lines) && (length == 0 || length+len(lines[end]) <= size) {
+			length += len(lines[end]) + 1
+			end++
+		}
+		chunk := strings.Join(lines[start:end], "\n")
+		if strings.TrimSpace(chunk) != "" {
+			chunks = append(chunks, Chunk{StartLine: start + 1, EndLine: end, Text: chunk})
+		}
+		if end == len(lines) {
+			break
+		}
+		// small chunks do not overlap, or they would be mostly the same
+		next := end - chunkOverlap
+		if next <= start+chunkOverlap {
+			next = end
+		}
+		start = next
+	}
+	return chunks
+}
+
+// get the embedding for the text from the embedded Ollama server
+func embed(c context.Context, model string, text string) ([]float64, error) {
+	reqJson, err := json.Marshal(&EmbeddingRequest{Model: model, Prompt: text})
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := postOllama(c, "/api/embeddings", reqJson)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != 200 {
+		return nil, fmt.Errorf("cannot embed with %s, status is %d, add the model first", model, httpResp.StatusCode)
+	}
+	resp := &EmbeddingResponse{}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Embedding, nil
+}
+
+// answer the query from the indexed documents that match the filter, citing
+// the files and lines used
+func docs(c context.Context, out Sink, model string, query string, filter Filter) (string, error) {
+	store, err := openStore()
+	if err != nil {
+		return "", err
+	}
+	if len(store.Documents) == 0 {
+		return "", fmt.Errorf("no documents have been indexed, use index first")
+	}
+	vector, err := embed(c, store.Model, query)
+	if err != nil {
+		return "", err
+	}
+	matches := store.Search(vector, cfg.Docs.Results, filter)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no indexed documents match the filter")
+	}
+	sources := []SearchResult{}
+	data := ""
+	n := excerptLength(c, model, len(matches))
+	for i, m := range matches {
+		sources = append(sources, SearchResult{Title: m.Location(), Url: m.Document.Path})
+		data += fmt.Sprintf("[%d]\nFile: %s\nContent: %s\n\n", i+1, m.Location(), truncate(m.Chunk.Text, n))
+	}
+	ctx, err := json.MarshalIndent(struct {
+		Query     string `json:"query"`
+		Documents string `json:"documents"`
+	}{query, data}, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	// add the files cited to the end of the answer
+	sink := &citeSink{Sink: out}
+	answer, err := predict(c, sink, model, cfg.Prompts.Docs, string(ctx), "")
+	if err != nil {
+		return answer, err
+	}
+	footer := checkCitations(answer, sources).Footer()
+	err = out.Token(footer)
+	out.Done(sink.stats)
+	return answer + footer, err
+}
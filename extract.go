@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/ledongthuc/pdf"
+)
+
+// Section is a part of a document, like a page of a PDF, a chapter of an
+// EPUB or the text under a heading in a DOCX file
+type Section struct {
+	// name used to cite the section, e.g. page 3, empty if the document has
+	// no sections
+	Name string
+	Text string
+}
+
+// read a document file and extract its text
+func readFile(file string) ([]Section, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return extractDocument(file, data)
+}
+
+// extract the text of a document by its file type, PDF, DOCX, EPUB and HTML
+// files are converted to text, any other file is taken as text
+func extractDocument(file string, data []byte) ([]Section, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".pdf":
+		return extractPDF(data)
+	case ".docx":
+		return extractDOCX(data)
+	case ".epub":
+		return extractEPUB(data)
+	case ".html", ".htm":
+		text, err := extractText(bytes.NewReader(data))
+		return []Section{{Text: text}}, err
+	}
+	return []Section{{Text: string(data)}}, nil
+}
+
+// extract the text of each page of a PDF file
+func extractPDF(data []byte) (sections []Section, err error) {
+	// the PDF reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			sections, err = nil, fmt.Errorf("cannot read PDF: %v", r)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read PDF: %w", err)
+	}
+	sections = []Section{}
+	for i := 1; i <= r.NumPage(); i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		// font names like /F1 are only the names of the fonts in the page
+		fonts := map[string]*pdf.Font{}
+		for _, name := range page.Fonts() {
+			font := page.Font(name)
+			fonts[name] = &font
+		}
+		text, err := page.GetPlainText(fonts)
+		if err != nil {
+			fmt.Println("err in reading PDF page:", err)
+			continue
+		}
+		if strings.TrimSpace(text) != "" {
+			sections = append(sections, Section{Name: fmt.Sprintf("page %d", i), Text: text})
+		}
+	}
+	return sections, nil
+}
+
+// read a file from a zip archive
+func readZipFile(r *zip.Reader, name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// extract the text of a DOCX file, in sections under each heading
+func extractDOCX(data []byte) ([]Section, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read DOCX: %w", err)
+	}
+	doc, err := readZipFile(r, "word/document.xml")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read DOCX: %w", err)
+	}
+
+	sections := []Section{{}}
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	// the text of a paragraph is in its text runs, other elements like field
+	// instructions also have character data
+	paragraph, heading, inText := &strings.Builder{}, false, false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read DOCX: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				paragraph.Reset()
+				heading = false
+			case "pStyle":
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "val" && (strings.HasPrefix(attr.Value, "Heading") || attr.Value == "Title") {
+						heading = true
+					}
+				}
+			case "t":
+				inText = true
+			case "tab":
+				paragraph.WriteString("\t")
+			case "br":
+				paragraph.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				paragraph.Write(t)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "t" {
+				inText = false
+			}
+			if t.Name.Local != "p" {
+				continue
+			}
+			text := strings.TrimSpace(paragraph.String())
+			if heading && text != "" {
+				sections = append(sections, Section{Name: text})
+			}
+			last := &sections[len(sections)-1]
+			last.Text += text + "\n"
+			paragraph.Reset()
+		}
+	}
+	return nonEmpty(sections), nil
+}
+
+// extract the text of each chapter of an EPUB file, in reading order
+func extractEPUB(data []byte) ([]Section, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read EPUB: %w", err)
+	}
+	// the container has the path of the package document, which lists the
+	// chapters in the spine
+	container := struct {
+		Rootfiles []struct {
+			Path string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}{}
+	data, err = readZipFile(r, "META-INF/container.xml")
+	if err == nil {
+		err = xml.Unmarshal(data, &container)
+	}
+	if err != nil || len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("cannot read EPUB container: %v", err)
+	}
+	opfPath := container.Rootfiles[0].Path
+	pkg := struct {
+		Items []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}{}
+	data, err = readZipFile(r, opfPath)
+	if err == nil {
+		err = xml.Unmarshal(data, &pkg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read EPUB package: %v", err)
+	}
+	hrefs := map[string]string{}
+	for _, item := range pkg.Items {
+		hrefs[item.ID] = item.Href
+	}
+
+	sections := []Section{}
+	for i, ref := range pkg.Spine {
+		href, ok := hrefs[ref.IDRef]
+		if !ok {
+			continue
+		}
+		data, err := readZipFile(r, path.Join(path.Dir(opfPath), href))
+		if err != nil {
+			fmt.Println("err in reading EPUB chapter:", err)
+			continue
+		}
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		name := fmt.Sprintf("chapter %d", i+1)
+		if title := strings.TrimSpace(doc.Find("h1, h2, title").First().Text()); title != "" {
+			name += ": " + strings.Join(strings.Fields(title), " ")
+		}
+		text, err := extractText(bytes.NewReader(data))
+		if err != nil || strings.TrimSpace(text) == "" {
+			continue
+		}
+		sections = append(sections, Section{Name: name, Text: text})
+	}
+	return sections, nil
+}
+
+// leave out the sections without text
+func nonEmpty(sections []Section) []Section {
+	results := []Section{}
+	for _, s := range sections {
+		if strings.TrimSpace(s.Text) != "" {
+			results = append(results, s)
+		}
+	}
+	return results
+}
+
+// format the files attached to a question for the prompt, with at most n
+// characters in all, shared equally by the files
+func formatFiles(files []string, n int) (string, error) {
+	if len(files) == 0 {
+		return "", nil
+	}
+	formatted := ""
+	for _, file := range files {
+		sections, err := readFile(file)
+		if err != nil {
+			return "", fmt.Errorf("cannot read %s: %w", file, err)
+		}
+		text := ""
+		for _, s := range sections {
+			name := filepath.Base(file)
+			if s.Name != "" {
+				name += ", " + s.Name
+			}
+			text += fmt.Sprintf("[%s]\n%s\n\n", name, strings.TrimSpace(s.Text))
+		}
+		formatted += strings.TrimSpace(truncate(text, n/len(files))) + "\n\n"
+	}
+	return formatted, nil
+}
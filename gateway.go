@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI compatible gateway, requests are routed to the provider that
+// serves the model, so OpenAI clients can use local and Gemini models too
+
+// POST /v1/chat/completions
+func (s *Server) chatCompletions(c *gin.Context) {
+	req := ChatCompletionRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		openaiError(c, http.StatusBadRequest, "invalid request, only text content is supported: "+err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		openaiError(c, http.StatusBadRequest, "messages is required")
+		return
+	}
+	m := s.modelFor(ServerRequest{Model: req.Model})
+
+	// system messages become the prompt, the rest is the conversation
+	prompts := []string{}
+	conv := &Conversation{}
+	for _, msg := range req.Messages {
+		if msg.Role == "system" {
+			prompts = append(prompts, msg.Content)
+		} else {
+			conv.Add(msg.Role, msg.Content)
+		}
+	}
+	prompt := strings.Join(prompts, "\n")
+
+	ctx, cancel := withGenerateTimeout(c.Request.Context())
+	defer cancel()
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := int(time.Now().Unix())
+	if !req.Stream {
+		stats := Stats{}
+		answer, err := getProvider(ctx, m).Chat(ctx, &FuncSink{OnDone: func(s Stats) { stats = s }}, m, prompt, conv)
+		if err != nil {
+			log.Println("cannot generate answer:", err)
+			openaiError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, OpenAIResponse{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   m,
+			Usage: Usage{
+				PromptTokens:     stats.PromptTokens,
+				CompletionTokens: stats.CompletionTokens,
+				TotalTokens:      stats.PromptTokens + stats.CompletionTokens,
+			},
+			Choices: []Choice{{
+				Message:      Message{Role: "assistant", Content: answer},
+				FinishReason: "stop",
+			}},
+		})
+		return
+	}
+
+	out := &chunkSink{c: c, id: id, created: created, model: m}
+	_, err := getProvider(ctx, m).Chat(ctx, out, m, prompt, conv)
+	if err != nil {
+		log.Println("cannot generate answer:", err)
+		// the status can only be changed if nothing has been streamed yet
+		if !out.started {
+			openaiError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+		data, _ := json.Marshal(gin.H{"error": gin.H{"message": err.Error(), "type": "server_error"}})
+		c.Writer.WriteString("data: " + string(data) + "\n\n")
+		c.Writer.WriteString("data: [DONE]\n\n")
+		c.Writer.Flush()
+	}
+}
+
+// GET /v1/models
+func (s *Server) listModels(c *gin.Context) {
+	models, err := catalog.Refresh(c.Request.Context())
+	if err != nil {
+		log.Println("cannot list models:", err)
+		openaiError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+	list := ModelList{Object: "list", Data: []ModelObject{}}
+	for _, m := range models {
+		list.Data = append(list.Data, ModelObject{ID: m.Name, Object: "model", OwnedBy: m.Provider})
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// respond with an error in the OpenAI format
+func openaiError(c *gin.Context, status int, message string) {
+	errType := "invalid_request_error"
+	if status >= http.StatusInternalServerError {
+		errType = "server_error"
+	}
+	c.JSON(status, gin.H{"error": gin.H{"message": message, "type": errType}})
+}
+
+// chunkSink sends each chunk as a chat completion chunk, the stream is only
+// started with the first chunk so that errors before it get an error status
+type chunkSink struct {
+	c       *gin.Context
+	id      string
+	created int
+	model   string
+	started bool
+}
+
+func (w *chunkSink) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.c.Header("Content-Type", "text/event-stream")
+	w.c.Header("Cache-Control", "no-cache")
+	w.c.Header("Connection", "keep-alive")
+	w.send(Delta{Role: "assistant"}, nil)
+}
+
+func (w *chunkSink) Token(chunk string) error {
+	w.start()
+	w.send(Delta{Content: chunk}, nil)
+	return w.c.Request.Context().Err()
+}
+
+func (w *chunkSink) Done(stats Stats) {
+	w.start()
+	stop := "stop"
+	w.send(Delta{}, &stop)
+	w.c.Writer.WriteString("data: [DONE]\n\n")
+	w.c.Writer.Flush()
+}
+
+func (w *chunkSink) send(delta Delta, finishReason *string) {
+	chunk := ChatCompletionChunk{
+		ID:      w.id,
+		Object:  "chat.completion.chunk",
+		Created: w.created,
+		Model:   w.model,
+		Choices: []ChunkChoice{{Delta: delta, FinishReason: finishReason}},
+	}
+	data, _ := json.Marshal(chunk)
+	w.c.Writer.WriteString("data: " + string(data) + "\n\n")
+	w.c.Writer.Flush()
+}
@@ -10,13 +10,10 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"github.com/h2non/filetype"
-	"github.com/hako/durafmt"
-	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -49,7 +46,7 @@ or instruction the query is an empty string "".
 	}
 
 	r := bytes.NewReader(reqJson)
-	httpResp, err := http.Post("http://localhost:11434/api/generate", "application/json", r)
+	httpResp, err := http.Post(cfg.ollamaURL()+"/api/generate", "application/json", r)
 	if err != nil {
 		fmt.Println("err in calling ollama:", err)
 		return query, err
@@ -70,27 +67,37 @@ or instruction the query is an empty string "".
 	return query, err
 }
 
-func askImage(model string, query string, images []string) error {
-	prompt := `Answer the question about a given image. Provide clear details in paragraph form, do not answer in point form or with numbered bullets. Only answer what you know, do not add any additional details that you do not have the answer to.`
-	switch model {
-	case "gpt-4-vision":
-		return gptImage("gpt-4-vision-preview", prompt, query, images)
-	case "gemini-pro-vision":
-		return geminiImage(model, prompt, query, images)
-	default:
-		return ollamaImage(model, prompt, query, images)
+// ask questions about the images, the turn is recorded in the session
+func askImage(c context.Context, out Sink, s *Session, model string, query string, images []string) (string, error) {
+	if !catalog.Lookup(c, model).Vision {
+		return "", fmt.Errorf("%s cannot answer questions on images", model)
 	}
-
+	c, cancel := withGenerateTimeout(c)
+	defer cancel()
+	t0 := time.Now()
+	answer, err := getProvider(c, model).PredictImage(c, out, model, cfg.Prompts.Image, query, images)
+	if err != nil {
+		return answer, err
+	}
+	return answer, s.AddTurn(Turn{
+		Model:    model,
+		Prompt:   query,
+		Answer:   answer,
+		Images:   images,
+		Time:     t0,
+		Duration: time.Since(t0),
+	})
 }
 
 // answer questions on images
-func ollamaImage(model string, prompt string, ctx string, images []string) error {
+func ollamaImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error) {
 	req := &CompletionRequest{
-		Model:  model,
-		Prompt: prompt,
-		System: ctx,
-		Images: []string{},
-		Stream: true,
+		Model:   model,
+		Prompt:  prompt,
+		System:  ctx,
+		Images:  []string{},
+		Options: catalog.Lookup(c, model).Options,
+		Stream:  true,
 	}
 	for _, img := range images {
 		file, err := os.ReadFile(img)
@@ -103,36 +110,24 @@ func ollamaImage(model string, prompt string, ctx string, images []string) error
 	reqJson, err := json.Marshal(req)
 	if err != nil {
 		fmt.Println("err in marshaling:", err)
-		return err
+		return "", err
 	}
 
-	r := bytes.NewReader(reqJson)
-	httpResp, err := http.Post("http://localhost:11435/api/generate", "application/json", r)
+	httpResp, err := postOllama(c, "/api/generate", reqJson)
 	if err != nil {
 		fmt.Println("err in calling ollama:", err)
-		return err
-	}
-	decoder := json.NewDecoder(httpResp.Body)
-	t0 := time.Now()
-	for {
-		resp := &CompletionResponse{}
-		decoder.Decode(&resp)
-		fmt.Print(resp.Response)
-		if resp.Done {
-			elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
-			fmt.Printf(cyan("\n\n(%s)\n"), elapsed)
-			break
-		}
+		return "", err
 	}
-	return err
+	defer httpResp.Body.Close()
+	return ollamaStream(httpResp.Body, newStream(out, model))
 }
 
-func geminiImage(model string, prompt string, ctx string, images []string) error {
-	t0 := time.Now()
-	client, err := genai.NewClient(context.Background(), option.WithAPIKey(os.Getenv("GOOGLEAI_API_KEY")))
+func geminiImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error) {
+	s := newStream(out, model)
+	client, err := genai.NewClient(c, option.WithAPIKey(cfg.Gemini.APIKey))
 	if err != nil {
 		fmt.Println("cannot create Gemini client:", err)
-		return err
+		return "", err
 	}
 	defer client.Close()
 
@@ -141,7 +136,7 @@ func geminiImage(model string, prompt string, ctx string, images []string) error
 		imgData, err := os.ReadFile(img)
 		if err != nil {
 			fmt.Println("cannot read image file:", err)
-			return err
+			return "", err
 		}
 		kind, _ := filetype.Match(imgData)
 		parts = append(parts, genai.ImageData(kind.MIME.Subtype, imgData))
@@ -149,37 +144,17 @@ func geminiImage(model string, prompt string, ctx string, images []string) error
 	parts = append(parts, genai.Text(prompt))
 	parts = append(parts, genai.Text(ctx))
 
-	gemini := client.GenerativeModel(model)
-	iter := gemini.GenerateContentStream(context.Background(), parts...)
-	for {
-		resp, err := iter.Next()
-		if err == iterator.Done {
-			elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
-			fmt.Printf(cyan("\n\n(%s)\n"), elapsed)
-			break
-		}
-		if err != nil {
-			fmt.Println("cannot generate content:", err)
-			return err
-		}
-		for _, cand := range resp.Candidates {
-			if cand.Content != nil {
-				for _, part := range cand.Content.Parts {
-					if part != nil {
-						s := fmt.Sprint(part)
-						if strings.TrimSpace(s) != "" {
-							fmt.Print(s)
-						}
-					}
-				}
-			}
-		}
+	gemini := geminiModel(c, client, model)
+	iter := gemini.GenerateContentStream(c, parts...)
+	err = geminiStream(iter, s)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return s.Done(Stats{}), nil
 }
 
-func gptImage(model string, prompt string, ctx string, images []string) error {
-	t0 := time.Now()
+func gptImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error) {
+	s := newStream(out, model)
 	pmpt := prompt + " ## " + ctx
 
 	b64s := []string{}
@@ -187,76 +162,73 @@ func gptImage(model string, prompt string, ctx string, images []string) error {
 		file, err := os.ReadFile(img)
 		if err != nil {
 			fmt.Println("cannot get read image file:", err)
-			return err
+			return "", err
 		}
 		b64s = append(b64s, base64.StdEncoding.EncodeToString(file))
 	}
-	response, err := callGPT4Vision(pmpt, b64s)
+	response, err := callGPT4Vision(c, model, pmpt, b64s)
 	if err != nil {
 		fmt.Println(red("cannot get response from OpenAI:", err))
+		return "", err
 	}
-	fmt.Print(response)
-	elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
-	fmt.Printf(cyan("\n\n(%s)\n"), elapsed)
-	return nil
+	err = s.Token(response)
+	if err != nil {
+		return "", err
+	}
+	return s.Done(Stats{}), nil
 }
 
-func callGPT4Vision(prompt string, imagesb64 []string) (string, error) {
-	imagePart := ""
+// ask an OpenAI vision model about the images
+func callGPT4Vision(c context.Context, model string, prompt string, imagesb64 []string) (string, error) {
+	content := []ContentPart{{Type: "text", Text: prompt}}
 	for _, imgb64 := range imagesb64 {
-		p := `{
-	"type": "image_url",
-	"image_url": {
-		"url": "` + fmt.Sprintf("data:image/jpeg;base64,%s", imgb64) + `" 
-	}
-},`
-		imagePart += p
+		content = append(content, ContentPart{
+			Type:     "image_url",
+			ImageURL: &ImageURL{URL: "data:image/jpeg;base64," + imgb64},
+		})
+	}
+	reqJson, err := json.Marshal(VisionRequest{
+		Model:     model,
+		Messages:  []VisionMessage{{Role: "user", Content: content}},
+		MaxTokens: 1024,
+	})
+	if err != nil {
+		fmt.Println("err in marshaling:", err)
+		return "", err
 	}
-	imagePart = imagePart[0 : len(imagePart)-1]
-	requestURL := "https://api.openai.com/v1/chat/completions"
-	jsonBody := `{
-	"model": "gpt-4-vision-preview",
-	"messages": [
-		{
-		"role": "user",
-		"content": [
-			{
-			"type": "text",
-			"text": "` + prompt + `"
-			},
-			` + imagePart + `
-		]
-		}
-	],
-	"max_tokens": 1024
-}`
 
-	bodyReader := bytes.NewReader([]byte(jsonBody))
-	req, err := http.NewRequest(http.MethodPost, requestURL, bodyReader)
+	requestURL := openaiBaseURL() + "/chat/completions"
+	req, err := http.NewRequestWithContext(c, http.MethodPost, requestURL, bytes.NewReader(reqJson))
 	if err != nil {
 		fmt.Printf("client: could not create request: %s\n", err)
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", os.Getenv("OPENAI_API_KEY")))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", cfg.OpenAI.APIKey))
 	client := http.Client{
-		Timeout: 30 * time.Second,
+		Timeout: cfg.Timeouts.Request,
 	}
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Printf("client: error making http request: %s\n", err)
 		return "", err
 	}
+	defer res.Body.Close()
 	resBody, err := io.ReadAll(res.Body)
-
 	if err != nil {
 		fmt.Printf("client: could not read response body: %s\n", err)
 		return "", err
 	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot get response from %s, status is %d: %s", model, res.StatusCode, bytes.TrimSpace(resBody))
+	}
 	response := OpenAIResponse{}
 	err = json.Unmarshal(resBody, &response)
 	if err != nil {
 		return "", err
 	}
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no response from %s", model)
+	}
 	return response.Choices[0].Message.Content, nil
 }
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
@@ -17,11 +19,18 @@ import (
 	"github.com/hako/durafmt"
 	"github.com/joho/godotenv"
 	"github.com/sausheong/ishell/v2"
+	"mvdan.cc/sh/v3/interp"
 )
 
 var model string
 var images []string
 
+// document files attached to the questions asked
+var attachments []string
+
+// output of a shell command attached to the questions asked
+var shellOutput *ShellOutput
+
 var cyan = color.New(color.FgCyan).SprintFunc()
 var yellow = color.New(color.FgHiYellow).SprintFunc()
 var white = color.New(color.FgWhite, color.Bold).SprintFunc()
@@ -29,16 +38,41 @@ var green = color.New(color.FgHiGreen, color.Bold).SprintFunc()
 var red = color.New(color.FgRed, color.Bold).SprintFunc()
 
 func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-	model = os.Getenv("MODEL")
 	gin.SetMode(gin.ReleaseMode)
-	go startOllamaServer()
 }
 
 func main() {
+	configFile := flag.String("config", "", "config file, overrides the user and project config files")
+	flagModel := flag.String("model", "", "model to use")
+	flagOllamaHost := flag.String("ollama-host", "", "host and port of the embedded Ollama server")
+	flagProfile := flag.String("profile", "", "shell profile with the policy for running commands")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	// the .env file is optional, its variables override the config files
+	godotenv.Load()
+	var err error
+	cfg, err = loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *flagModel != "" {
+		cfg.Model = *flagModel
+	}
+	if *flagOllamaHost != "" {
+		cfg.Ollama.Host = *flagOllamaHost
+	}
+	if *flagProfile != "" {
+		cfg.Shell.Profile = *flagProfile
+	}
+	model = cfg.Model
+	go startOllamaServer()
+
+	// run a single command and exit if one is given
+	if flag.NArg() > 0 {
+		os.Exit(runOnce(flag.Args()))
+	}
+
 	shell := ishell.New()
 
 	// display info.
@@ -55,49 +89,203 @@ func main() {
 			if line == "" || line == "exit" {
 				return
 			}
-			args := strings.Split(line, " ")
-			out, err := run(args[0], args[1:])
+			// the shell keeps its working directory and variables between
+			// command lines
+			ctx, stop := interruptible()
+			out, err := run(ctx, line, confirmShell(c), colorWriter{os.Stdout, yellow}, colorWriter{os.Stderr, red})
+			stop()
+			printRunError(c, ctx, err)
+			diagnose(c, line, out, err)
+			c.Cmd.Func(c)
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "do",
+		Help: "describe a task and run the shell command proposed for it",
+		Func: func(c *ishell.Context) {
+			c.Print(cyan("do> "))
+			line := c.ReadLine()
+			defer c.SetPrompt(getPrompt())
+			if line == "" || line == "exit" {
+				return
+			}
+			ctx, stop := interruptible()
+			resp, err := proposeCommand(ctx, model, line)
+			stop()
 			if err != nil {
-				c.Println(red(string(out)))
-				c.Println(red(err))
+				printError(c, ctx, err)
+				c.Cmd.Func(c)
 				return
-			} else {
-				if len(out) > 0 {
-					c.Println(yellow(string(out)))
-				}
 			}
+			runProposed(c, resp, "run this command?")
 			c.Cmd.Func(c)
 		},
 	})
 
 	shell.AddCmd(&ishell.Cmd{
 		Name: "ask",
-		Help: "ask waldo",
+		Help: "ask waldo, e.g. ask < shell:go test ./... to ask about the output of a command",
 		Func: func(c *ishell.Context) {
+			// ask < shell:command attaches the output of the command, and
+			// ask < shell the output of the last command run
+			if len(c.Args) > 0 {
+				source := strings.TrimSpace(strings.TrimPrefix(shellWords(c.Args), "<"))
+				if source != "shell" && !strings.HasPrefix(source, "shell:") {
+					c.Println(red("use ask < shell or ask < shell:command"))
+					return
+				}
+				attachOutput(c, strings.TrimPrefix(strings.TrimPrefix(source, "shell"), ":"))
+				c.Args = nil
+			}
 			c.Print(cyan("ask> "))
 			line := c.ReadLine()
 			defer c.SetPrompt(getPrompt())
 			if line == "" || line == "exit" {
 				return
 			}
-			ask(model, line)
+			if strings.HasPrefix(line, "/new") {
+				session = newSession()
+				attachments = []string{}
+				shellOutput = nil
+				c.Println(yellow("new session started."))
+			} else if strings.HasPrefix(line, "/file") {
+				// attach document files to the questions that follow
+				for _, file := range strings.Fields(strings.TrimPrefix(line, "/file")) {
+					if _, err := os.Stat(file); err != nil {
+						c.Println(red("cannot attach file:", err))
+						continue
+					}
+					attachments = append(attachments, file)
+				}
+				if len(attachments) == 0 {
+					c.Println(yellow("no files attached."))
+				} else {
+					c.Println(yellow("attached:", strings.Join(getFilenames(attachments), ", ")))
+				}
+			} else if strings.HasPrefix(line, "/shell") {
+				attachOutput(c, strings.TrimSpace(strings.TrimPrefix(line, "/shell")))
+			} else {
+				ctx, stop := interruptible()
+				_, err := ask(ctx, terminalSink(), session, model, line, attachments, shellOutput)
+				stop()
+				if err != nil {
+					printError(c, ctx, err)
+				}
+			}
 			c.Cmd.Func(c)
 		},
 	})
 
 	shell.AddCmd(&ishell.Cmd{
 		Name: "search",
-		Help: "search the Internet",
+		Help: "search the Internet, e.g. search --engine searxng --rewrite --site gov.sg --filetype pdf --region sg --time week",
 		Func: func(c *ishell.Context) {
+			opts, err := searchFlags(c.Args)
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
 			c.Print(cyan("search> "))
 			line := c.ReadLine()
 			defer c.SetPrompt(getPrompt())
 			if line == "" || line == "exit" {
 				return
 			}
-			err := search(model, line)
+			ctx, stop := interruptible()
+			_, err = search(ctx, terminalSink(), model, line, opts)
+			stop()
+			if err != nil {
+				printError(c, ctx, err)
+			}
+			c.Cmd.Func(c)
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "research",
+		Help: "research a question with several searches and write a report, takes the same options as search",
+		Func: func(c *ishell.Context) {
+			opts, err := searchFlags(c.Args)
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			c.Print(cyan("research> "))
+			line := c.ReadLine()
+			defer c.SetPrompt(getPrompt())
+			if line == "" || line == "exit" {
+				return
+			}
+			ctx, stop := interruptible()
+			r, err := research(ctx, terminalSink(), model, line, opts, func(status string) {
+				c.Println(cyan("(" + status + ")"))
+			})
+			stop()
+			if err != nil {
+				printError(c, ctx, err)
+			} else {
+				c.Print(cyan("save report to file? "))
+				file := strings.TrimSpace(c.ReadLine())
+				if file != "" {
+					err = r.Save(file)
+					if err != nil {
+						c.Println(red("cannot save report:", err))
+					} else {
+						c.Println(yellow("saved to " + file))
+					}
+				}
+			}
+			c.Cmd.Func(c)
+		},
+	})
+
+	// index local documents to answer questions on them
+	shell.AddCmd(&ishell.Cmd{
+		Name: "index",
+		Help: "index the documents in a directory for docs, e.g. index ~/notes",
+		Func: func(c *ishell.Context) {
+			dir := strings.Join(c.Args, " ")
+			if dir == "" {
+				c.Print(cyan("directory? "))
+				dir = strings.TrimSpace(c.ReadLine())
+				if dir == "" {
+					return
+				}
+			}
+			ctx, stop := interruptible()
+			store, stats, err := indexDocs(ctx, dir, func(file string) {
+				c.Println(cyan("(indexing " + file + ")"))
+			})
+			stop()
+			if err != nil {
+				printError(c, ctx, err)
+				return
+			}
+			c.Println(yellow(fmt.Sprintf("%s, %d chunks in %d documents indexed.", stats, store.Len(), len(store.Documents))))
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "docs",
+		Help: "ask questions on the indexed documents, e.g. docs --path notes --type md --tag work",
+		Func: func(c *ishell.Context) {
+			filter, err := docsFlags(c.Args)
 			if err != nil {
 				c.Println(red(err))
+				return
+			}
+			c.Print(cyan("docs> "))
+			line := c.ReadLine()
+			defer c.SetPrompt(getPrompt())
+			if line == "" || line == "exit" {
+				return
+			}
+			ctx, stop := interruptible()
+			_, err = docs(ctx, terminalSink(), model, line, filter)
+			stop()
+			if err != nil {
+				printError(c, ctx, err)
 			}
 			c.Cmd.Func(c)
 		},
@@ -109,7 +297,10 @@ func main() {
 		Help: "ask questions about an image file",
 		Func: func(c *ishell.Context) {
 			defer c.SetPrompt(getPrompt())
-			if !isImageModel() {
+			ctx, stop := interruptible()
+			vision := isImageModel(ctx)
+			stop()
+			if !vision {
 				c.Println(red("Please switch to an image model like llava or Gemini-Pro-Vision or GPT-4-Vision first."))
 				return
 			}
@@ -135,7 +326,12 @@ func main() {
 					fmt.Println(red("showing inline images only available on iTerm2."))
 				}
 			} else {
-				askImage(model, line, images)
+				ctx, stop := interruptible()
+				_, err := askImage(ctx, terminalSink(), session, model, line, images)
+				stop()
+				if err != nil {
+					printError(c, ctx, err)
+				}
 			}
 			c.Cmd.Func(c)
 		},
@@ -152,14 +348,23 @@ func main() {
 		Name: "switch",
 		Help: "switch to a different model",
 		Func: func(c *ishell.Context) {
-			choices, err := getModels()
+			ctx, stop := interruptible()
+			models, err := catalog.Refresh(ctx)
+			stop()
 			if err != nil {
 				log.Println(err)
 				c.Println(red("model not switched."))
 				return
 			}
+			choices := []string{}
+			for _, m := range models {
+				choices = append(choices, m.String())
+			}
 			choice := c.MultiChoice(choices, cyan("Your current model is ")+yellow(model)+cyan(". Which model to switch to?"))
-			model = choices[choice]
+			if choice < 0 {
+				return
+			}
+			model = models[choice].Name
 			c.SetPrompt(getPrompt())
 			c.Println()
 		},
@@ -175,19 +380,215 @@ func main() {
 			if line == "" || line == "exit" {
 				return
 			}
-			err := pullModel(line)
+			ctx, stop := interruptible()
+			err := pullModel(ctx, line)
+			stop()
 			if err != nil {
-				c.Println(red(err))
+				printError(c, ctx, err)
 			}
 			c.Println()
 		},
 	})
 
+	// saved sessions
+	sessionsCmd := &ishell.Cmd{
+		Name: "sessions",
+		Help: "list, resume, rename and delete saved sessions",
+		Func: func(c *ishell.Context) {
+			sessions, err := listSessions()
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			for _, s := range sessions {
+				if s.ID == session.ID {
+					c.Println(green(s))
+				} else {
+					c.Println(yellow(s))
+				}
+			}
+		},
+	}
+	sessionsCmd.AddCmd(&ishell.Cmd{
+		Name: "resume",
+		Help: "resume a saved session",
+		Func: func(c *ishell.Context) {
+			s, err := chooseSession(c, "Which session to resume?")
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			session = s
+			if s.Model != "" {
+				model = s.Model
+			}
+			for _, turn := range s.Turns {
+				c.Println(cyan("ask> ") + turn.Prompt)
+				c.Println(summarize(turn.Answer, 80))
+			}
+			c.Println(yellow("resumed session " + s.Name + " with model " + model + "."))
+		},
+	})
+	sessionsCmd.AddCmd(&ishell.Cmd{
+		Name: "rename",
+		Help: "rename a saved session",
+		Func: func(c *ishell.Context) {
+			s, err := chooseSession(c, "Which session to rename?")
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			c.Print(cyan("new name? "))
+			name := strings.TrimSpace(c.ReadLine())
+			if name == "" {
+				return
+			}
+			s.Name = name
+			if s.ID == session.ID {
+				session.Name = name
+			}
+			err = s.Save()
+			if err != nil {
+				c.Println(red(err))
+			}
+		},
+	})
+	sessionsCmd.AddCmd(&ishell.Cmd{
+		Name: "delete",
+		Help: "delete a saved session",
+		Func: func(c *ishell.Context) {
+			s, err := chooseSession(c, "Which session to delete?")
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			err = deleteSession(s.ID)
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			if s.ID == session.ID {
+				session = newSession()
+			}
+			c.Println(yellow("deleted session " + s.Name + "."))
+		},
+	})
+	shell.AddCmd(sessionsCmd)
+
+	// inspect and purge the cached search results and pages
+	cacheCmd := &ishell.Cmd{
+		Name: "cache",
+		Help: "list and purge the cached search results and pages",
+		Func: func(c *ishell.Context) {
+			entries, err := listCache()
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			for _, entry := range entries {
+				if entry.Expired() {
+					c.Println(cyan(entry))
+				} else {
+					c.Println(yellow(entry))
+				}
+			}
+			c.Println(yellow(fmt.Sprintf("%d cached searches and pages.", len(entries))))
+		},
+	}
+	cacheCmd.AddCmd(&ishell.Cmd{
+		Name: "purge",
+		Help: "purge the cache, e.g. cache purge expired, cache purge search, cache purge page, or all if not given",
+		Func: func(c *ishell.Context) {
+			what := strings.Join(c.Args, " ")
+			match := func(e *CacheEntry) bool { return true }
+			switch what {
+			case "", "all":
+			case "expired":
+				match = func(e *CacheEntry) bool { return e.Expired() }
+			case cacheSearch, cachePage:
+				match = func(e *CacheEntry) bool { return e.Kind == what }
+			default:
+				// entries with the key, e.g. the URL of a page
+				match = func(e *CacheEntry) bool { return strings.Contains(e.Key, what) }
+			}
+			n, err := purgeCache(match)
+			if err != nil {
+				c.Println(red(err))
+			}
+			c.Println(yellow(fmt.Sprintf("purged %d cached searches and pages.", n)))
+		},
+	})
+	shell.AddCmd(cacheCmd)
+
+	// view and edit the configuration
+	configCmd := &ishell.Cmd{
+		Name: "config",
+		Help: "view and edit the configuration",
+		Func: func(c *ishell.Context) {
+			c.Println(yellow(cfg))
+		},
+	}
+	configCmd.AddCmd(&ishell.Cmd{
+		Name: "get",
+		Help: "get a setting, e.g. config get search.results",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) != 1 {
+				c.Println(red("usage: config get <setting>"))
+				return
+			}
+			value, err := cfg.Get(c.Args[0])
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			c.Println(yellow(value))
+		},
+	})
+	configCmd.AddCmd(&ishell.Cmd{
+		Name: "set",
+		Help: "change a setting, e.g. config set search.results 8",
+		Func: func(c *ishell.Context) {
+			if len(c.Args) < 2 {
+				c.Println(red("usage: config set <setting> <value>"))
+				return
+			}
+			err := cfg.Set(c.Args[0], strings.Join(c.Args[1:], " "))
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			if c.Args[0] == "model" {
+				model = cfg.Model
+			}
+		},
+	})
+	configCmd.AddCmd(&ishell.Cmd{
+		Name: "save",
+		Help: "save the configuration to the user config file",
+		Func: func(c *ishell.Context) {
+			// the model switched to is saved too
+			if model != cfg.Model {
+				cfg.Set("model", model)
+			}
+			path, err := cfg.Save()
+			if err != nil {
+				c.Println(red(err))
+				return
+			}
+			c.Println(yellow("saved to " + path + "."))
+		},
+	})
+	shell.AddCmd(configCmd)
+
 	shell.AddCmd(&ishell.Cmd{
 		Name: "info",
 		Help: "information about Waldo",
 		Func: func(c *ishell.Context) {
-			c.Println(yellow("model:"), cyan(model))
+			ctx, stop := interruptible()
+			info := catalog.Lookup(ctx, model)
+			stop()
+			c.Println(yellow("model:"), cyan(info))
+			c.Println(yellow("session:"), cyan(session.ID, " ", session.Name))
 			c.SetPrompt(getPrompt())
 			c.Println()
 		},
@@ -204,29 +605,133 @@ func exit(c *ishell.Context) {
 	c.Stop()
 }
 
+// context that is cancelled when the user presses Ctrl-C, call stop when
+// done to restore the default Ctrl-C behaviour
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// print the error, or a marker if the user cancelled with Ctrl-C
+func printError(c *ishell.Context, ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		c.Println(cyan("\n(cancelled)"))
+		return
+	}
+	c.Println(red(err))
+}
+
+// print the error from running a command, the exit status of the command
+// has already been reported
+func printRunError(c *ishell.Context, ctx context.Context, err error) {
+	if _, ok := interp.IsExitStatus(err); err != nil && !ok {
+		printError(c, ctx, err)
+	}
+}
+
+// attach the output of the command to the questions that follow, running
+// it in the shell first, or the output of the last command run if no command
+// is given
+func attachOutput(c *ishell.Context, command string) {
+	var last *ShellOutput
+	if sh != nil {
+		last = sh.Last
+	}
+	if command != "" {
+		ctx, stop := interruptible()
+		_, err := run(ctx, command, confirmShell(c), colorWriter{os.Stdout, yellow}, colorWriter{os.Stderr, red})
+		stop()
+		printRunError(c, ctx, err)
+		// the command was not run
+		if sh == nil || sh.Last == last {
+			return
+		}
+		last = sh.Last
+	}
+	if last == nil {
+		c.Println(red("no shell command has been run yet."))
+		return
+	}
+	shellOutput = last
+	c.Println(yellow("attached the output of " + last.Command))
+}
+
+// run a command proposed by the model if the user confirms it
+func runProposed(c *ishell.Context, resp *CommandResponse, question string) {
+	c.Print(resp.Describe())
+	if err := resp.Check(); err != nil {
+		c.Println(red(err))
+		return
+	}
+	c.Print(cyan(question + " [y/N] "))
+	if !confirmed(c.ReadLine()) {
+		c.Println(yellow("command not run."))
+		return
+	}
+	// the command has been confirmed
+	ctx, stop := interruptible()
+	out, err := runCommand(ctx, resp, func(string) bool { return true }, colorWriter{os.Stdout, yellow}, colorWriter{os.Stderr, red})
+	stop()
+	printRunError(c, ctx, err)
+	diagnose(c, resp.Command, out, err)
+}
+
+// if diagnosing is turned on and the command exited with an error, explain
+// why it failed and offer to run the command the model suggests instead
+func diagnose(c *ishell.Context, line string, out []byte, err error) {
+	status, ok := interp.IsExitStatus(err)
+	if !cfg.Shell.Diagnose || !ok || status == 0 {
+		return
+	}
+	c.Println(cyan("(diagnosing)"))
+	ctx, stop := interruptible()
+	resp, err := diagnoseCommand(ctx, model, line, status, out)
+	stop()
+	if err != nil {
+		printError(c, ctx, err)
+		return
+	}
+	if resp.Command == "" {
+		c.Println(strings.TrimSpace(resp.Explanation))
+		return
+	}
+	runProposed(c, resp, "run the suggested command?")
+}
+
+// ask the user to confirm a command the shell policy wants confirmed
+func confirmShell(c *ishell.Context) func(string) bool {
+	return func(line string) bool {
+		c.Print(cyan(line + " needs to be confirmed, run it? [y/N] "))
+		return confirmed(c.ReadLine())
+	}
+}
+
 func getPrompt() string {
 	return "waldo> "
 }
 
-func isImageModel() bool {
-	return strings.Contains(model, "llava") || strings.Contains(model, "-vision")
+func isImageModel(c context.Context) bool {
+	return catalog.Lookup(c, model).Vision
 }
 
-func pullModel(name string) error {
+func pullModel(c context.Context, name string) error {
 	reqJson := `{
 	"name": "` + name + `"
 }`
-	r := bytes.NewReader([]byte(reqJson))
-	httpResp, err := http.Post("http://localhost:11435/api/pull", "application/json", r)
+	httpResp, err := postOllama(c, "/api/pull", []byte(reqJson))
 	if err != nil {
 		fmt.Println("err in calling ollama:", err)
 		return err
 	}
+	defer httpResp.Body.Close()
 	decoder := json.NewDecoder(httpResp.Body)
 	t0 := time.Now()
 	for {
 		resp := &PullResponse{}
-		decoder.Decode(&resp)
+		err = decoder.Decode(&resp)
+		if err != nil {
+			fmt.Print("\033[2K\r")
+			return err
+		}
 		if resp.Status == "success" {
 			elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
 			fmt.Print("\033[2K\r")
@@ -234,7 +739,7 @@ func pullModel(name string) error {
 			fmt.Println()
 			break
 		} else {
-			if resp.Status[0:7] == "pulling" {
+			if strings.HasPrefix(resp.Status, "pulling") {
 				fmt.Print("\033[2K\r")
 				percentage := float64(resp.Completed) * 100.0 / float64(resp.Total)
 				if percentage < 100.0 && percentage != 0.0 {
@@ -245,29 +750,67 @@ func pullModel(name string) error {
 			}
 		}
 	}
-	return err
+	return nil
 }
 
-func getModels() ([]string, error) {
-	models := &Models{}
-	httpResp, err := http.Get("http://localhost:11435/api/tags")
+// get the names of the models from all the registered providers
+func getModels(c context.Context) ([]string, error) {
+	models, err := catalog.Refresh(c)
 	if err != nil {
-		fmt.Println("err in calling ollama:", err)
 		return []string{}, err
 	}
-	decoder := json.NewDecoder(httpResp.Body)
-	err = decoder.Decode(models)
-	if err != nil {
-		fmt.Println("err in getting models:", err)
-		return []string{}, err
+	results := []string{}
+	for _, m := range models {
+		results = append(results, m.Name)
 	}
+	return results, nil
+}
 
-	results := []string{"gpt-3.5-turbo", "gpt-4", "gpt-4-turbo", "gpt-4-vision", "gemini-pro", "gemini-pro-vision"}
-	for _, m := range models.Models {
-		results = append(results, m.Name)
+// get the search options from the flags in the arguments, e.g.
+// --engine searxng --site gov.sg
+func searchFlags(args []string) (SearchOptions, error) {
+	opts := SearchOptions{}
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	opts.AddFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return opts, err
 	}
+	return opts, opts.Validate()
+}
 
-	return results, nil
+// get the filter for the documents from the flags in the arguments, e.g.
+// --type md --tag work
+func docsFlags(args []string) (Filter, error) {
+	filter := Filter{}
+	flags := flag.NewFlagSet("docs", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	filter.AddFlags(flags)
+	return filter, flags.Parse(args)
+}
+
+// choose a session by the id given as an argument, or from the list of saved sessions
+func chooseSession(c *ishell.Context, text string) (*Session, error) {
+	if len(c.Args) > 0 {
+		return loadSession(c.Args[0])
+	}
+	sessions, err := listSessions()
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("there are no saved sessions")
+	}
+	choices := []string{}
+	for _, s := range sessions {
+		choices = append(choices, s.String())
+	}
+	choice := c.MultiChoice(choices, cyan(text))
+	if choice < 0 {
+		return nil, fmt.Errorf("no session chosen")
+	}
+	return sessions[choice], nil
 }
 
 func getFilenames(filepaths []string) []string {
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/jmorganca/ollama/format"
 	"github.com/jmorganca/ollama/server"
@@ -20,14 +22,7 @@ import (
 
 // start the OllamaServer
 func startOllamaServer() error {
-	host, port, err := net.SplitHostPort(os.Getenv("OLLAMA_HOST"))
-	if err != nil {
-		host, port = "127.0.0.1", "11435"
-		if ip := net.ParseIP(strings.Trim(os.Getenv("OLLAMA_HOST"), "[]")); ip != nil {
-			host = ip.String()
-		}
-	}
-
+	host, port := cfg.ollamaAddr()
 	if err := initializeKeypair(); err != nil {
 		return err
 	}
@@ -89,3 +84,14 @@ func initializeKeypair() error {
 	}
 	return nil
 }
+
+// post a JSON request to the embedded Ollama server, the request is
+// aborted when c is cancelled
+func postOllama(c context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c, http.MethodPost, cfg.ollamaURL()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(req)
+}
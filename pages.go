@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// Page is a search result with the text of the page behind it
+type Page struct {
+	SearchResult
+	// main text of the page, empty if it was not fetched
+	Text string
+}
+
+// largest page that is read
+const maxPageSize = 2 << 20
+
+// elements that are not part of the main text of a page
+const boilerplate = "script, style, noscript, iframe, svg, form, button, nav, header, footer, aside, " +
+	"[role=navigation], [role=banner], [role=contentinfo], [role=complementary], [aria-hidden=true]"
+
+// fetch the pages for the top n results at the same time, results that
+// cannot be fetched are kept without the text. Cached pages are used unless
+// fresh is set.
+func fetchPages(c context.Context, results []SearchResult, n int, fresh bool) []Page {
+	pages := make([]Page, len(results))
+	var wg sync.WaitGroup
+	for i, result := range results {
+		pages[i].SearchResult = result
+		if i >= n || result.Url == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(page *Page) {
+			defer wg.Done()
+			text, err := cachedPage(c, page.Url, fresh)
+			if err != nil {
+				fmt.Println("err in fetching page:", err)
+				return
+			}
+			page.Text = text
+		}(&pages[i])
+	}
+	wg.Wait()
+	return pages
+}
+
+// fetch a page and extract its main text
+func fetchPage(c context.Context, pageURL string) (string, error) {
+	client := &http.Client{Timeout: cfg.Timeouts.Request}
+	request, err := http.NewRequestWithContext(c, "GET", pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("User-Agent", cfg.Search.UserAgent)
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s status is %d", pageURL, response.StatusCode)
+	}
+	contentType := response.Header.Get("Content-Type")
+	if contentType != "" && !strings.Contains(contentType, "html") && !strings.HasPrefix(contentType, "text/") {
+		return "", fmt.Errorf("%s is %s, not a web page", pageURL, contentType)
+	}
+	return extractText(io.LimitReader(response.Body, maxPageSize))
+}
+
+// extract the main text from an HTML page, leaving out the navigation,
+// headers, footers, ads and other boilerplate
+func extractText(r io.Reader) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return "", err
+	}
+	doc.Find(boilerplate).Remove()
+
+	// use the article if the page marks it, otherwise the element with the
+	// most text in its paragraphs
+	content := doc.Find("article, main, [role=main]").First()
+	if content.Length() == 0 {
+		scores := map[*html.Node]int{}
+		parents := []*html.Node{}
+		doc.Find("p").Each(func(i int, p *goquery.Selection) {
+			if parent := p.Parent(); parent.Length() > 0 {
+				if _, ok := scores[parent.Get(0)]; !ok {
+					parents = append(parents, parent.Get(0))
+				}
+				scores[parent.Get(0)] += len(strings.TrimSpace(p.Text()))
+			}
+		})
+		best := 0
+		for _, parent := range parents {
+			if scores[parent] > best {
+				content, best = doc.FindNodes(parent), scores[parent]
+			}
+		}
+	}
+	if content.Length() == 0 {
+		content = doc.Find("body")
+	}
+
+	lines := []string{}
+	blocks := content.Find("h1, h2, h3, h4, h5, h6, p, li, pre, blockquote, td")
+	if blocks.Length() == 0 {
+		blocks = content
+	}
+	blocks.Each(func(i int, s *goquery.Selection) {
+		// nested blocks are added through their own elements
+		if s.Find("p, li, pre, blockquote").Length() > 0 {
+			return
+		}
+		line := strings.Join(strings.Fields(s.Text()), " ")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	})
+	return strings.Join(lines, "\n"), nil
+}
+
+// number of characters of each page that fit in the model's context window,
+// leaving room for the prompt and the answer, at about 4 characters a token
+func excerptLength(c context.Context, model string, pages int) int {
+	if pages == 0 {
+		return 0
+	}
+	return catalog.Lookup(c, model).ContextWindow / 2 * 4 / pages
+}
+
+// truncate the text to at most n characters, at the end of a line or word
+func truncate(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndexAny(cut, "\n "); i > n/2 {
+		cut = cut[:i]
+	}
+	return cut + "..."
+}
+
+// format the pages for the prompt, with at most n characters of each page,
+// numbering them from 1 so that they can be cited
+func formatPages(pages []Page, n int) string {
+	formatted := ""
+	for i, page := range pages {
+		formatted += fmt.Sprintf("[%d]\n"+
+			"Title: %s\n"+
+			"URL: %s\n"+
+			"Description: %s\n", i+1, page.Title, page.Url, page.Info)
+		if page.Text != "" {
+			formatted += fmt.Sprintf("Content: %s\n", truncate(page.Text, n))
+		}
+		formatted += "\n"
+	}
+	return formatted
+}
+
+// get the URL of the result from a DuckDuckGo link, which redirects through
+// DuckDuckGo with the URL in the uddg parameter
+func ddgURL(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	if target := u.Query().Get("uddg"); target != "" {
+		return target
+	}
+	if u.Scheme == "" && strings.HasPrefix(href, "//") {
+		return "https:" + href
+	}
+	return href
+}
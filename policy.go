@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CommandPolicy decides which shell commands can be run, and which are only
+// run after the user confirms them
+type CommandPolicy struct {
+	// programs that can be run, any program can be run if empty
+	Allow []string `yaml:"allow"`
+	// regular expressions for the command lines that are never run
+	Deny []string `yaml:"deny"`
+	// regular expressions for the command lines that are only run after
+	// confirming them
+	Confirm []string `yaml:"confirm"`
+	// show the commands without running them
+	DryRun bool `yaml:"dry_run"`
+}
+
+// command lines that are never run by the built-in profiles
+var denyCommands = []string{
+	// removing the root or home directory, or everything in them
+	`\brm\s+(-\S+\s+)*(-\w*[rR]\w*|--recursive)\s+(-\S+\s+)*["']?(/|~|\$HOME|\$\{HOME\})["']?/?["']?\*?["']?(\s|$)`,
+	`\bmkfs(\.\w+)?\b`,
+	`\bdd\b.*\bof=/dev/`,
+	`>\s*/dev/(sd|hd|nvme|disk)`,
+	`\bchmod\s+(-\S+\s+)*777\s+/(\s|$)`,
+	`\b(shutdown|reboot|halt|poweroff)\b`,
+	// fork bomb
+	`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`,
+}
+
+// command lines that change or remove things, confirmed by the built-in
+// profiles
+var confirmCommands = []string{
+	`\b(rm|rmdir|mv|dd|shred|truncate|chmod|chown|kill|killall|pkill)\b`,
+	`\bsudo\b`,
+	`\bgit\s+(push|reset\s+--hard|clean|checkout\s+--)\b`,
+}
+
+// built-in policy profiles, profiles in the config file with the same name
+// replace them
+func defaultProfiles() map[string]CommandPolicy {
+	return map[string]CommandPolicy{
+		"default": {
+			Deny:    denyCommands,
+			Confirm: confirmCommands,
+		},
+		// only programs that read and do not change anything
+		"strict": {
+			Allow: []string{"ls", "pwd", "cat", "head", "tail", "grep", "find", "wc", "sort", "uniq",
+				"cut", "tr", "echo", "which", "file", "stat", "du", "df", "ps", "date", "whoami", "uname"},
+			Deny:    denyCommands,
+			Confirm: confirmCommands,
+		},
+		"dry-run": {
+			Deny:    denyCommands,
+			Confirm: confirmCommands,
+			DryRun:  true,
+		},
+	}
+}
+
+// the policy of the profile in the config
+func commandPolicy() (CommandPolicy, error) {
+	p, ok := cfg.Shell.Profiles[cfg.Shell.Profile]
+	if !ok {
+		names := []string{}
+		for name := range cfg.Shell.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return p, fmt.Errorf("no such shell profile %s, use one of %s", cfg.Shell.Profile, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// check the command line against the policy, returns an error if it cannot
+// be run, and whether it needs to be confirmed
+func (p CommandPolicy) Check(line string) (bool, error) {
+	file, err := parseCommand(line)
+	if err != nil {
+		return false, err
+	}
+	line = strings.Join(strings.Fields(line), " ")
+	err = p.deny(line)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range commandNames(file) {
+		err = p.allow(name)
+		if err != nil {
+			return false, err
+		}
+	}
+	return p.confirm(line)
+}
+
+// check a program and its expanded arguments against the policy, relative
+// paths are in the directory dir. Returns an error if it cannot be run.
+func (p CommandPolicy) CheckProgram(dir string, args []string) error {
+	err := p.deny(strings.Join(rootAndHome(dir, args), " "))
+	if err != nil {
+		return err
+	}
+	return p.allow(filepath.Base(args[0]))
+}
+
+// the arguments with the paths that are the root or home directory, once
+// expanded, written back as / and ~, and the paths directly in them as /* and
+// ~/*, so that the deny patterns match them. Globs like ~/* are expanded to
+// every file in the directory before the program is checked.
+func rootAndHome(dir string, args []string) []string {
+	home, err := os.UserHomeDir()
+	if err == nil {
+		home = filepath.Clean(home)
+	}
+	words := []string{args[0]}
+	for _, arg := range args[1:] {
+		if arg != "" && !strings.HasPrefix(arg, "-") {
+			path := arg
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			path = filepath.Clean(path)
+			switch {
+			case path == "/":
+				arg = "/"
+			case path == home:
+				arg = "~"
+			case filepath.Dir(path) == "/":
+				arg = "/*"
+			case filepath.Dir(path) == home:
+				arg = "~/*"
+			}
+		}
+		words = append(words, arg)
+	}
+	return words
+}
+
+func (p CommandPolicy) deny(line string) error {
+	for _, pattern := range p.Deny {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid deny pattern %s: %w", pattern, err)
+		}
+		if re.MatchString(line) {
+			return fmt.Errorf("%s is denied by the %s shell profile", line, cfg.Shell.Profile)
+		}
+	}
+	return nil
+}
+
+func (p CommandPolicy) confirm(line string) (bool, error) {
+	for _, pattern := range p.Confirm {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid confirm pattern %s: %w", pattern, err)
+		}
+		if re.MatchString(line) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p CommandPolicy) allow(name string) error {
+	if len(p.Allow) > 0 && !contains(p.Allow, name) {
+		return fmt.Errorf("%s is not allowed by the %s shell profile", name, cfg.Shell.Profile)
+	}
+	return nil
+}
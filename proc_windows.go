@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// process groups are not used on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Windows cannot interrupt a process, so it is killed
+func signalProcessGroup(cmd *exec.Cmd, kill bool) {
+	cmd.Process.Signal(os.Kill)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Provider is a backend that serves one or more models
+type Provider interface {
+	// name of the provider
+	Name() string
+	// list of models served by the provider and what they can do
+	Models(c context.Context) ([]ModelInfo, error)
+	// predict using a prompt and the user's input, streaming the answer to
+	// the sink and returning it, generation stops when c is cancelled
+	Predict(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error)
+	// chat using a prompt and the conversation so far
+	Chat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error)
+	// predict using a prompt, the user's input and one or more image files
+	PredictImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error)
+}
+
+// registered providers
+var providers []Provider
+
+// Ollama serves any model not claimed by another provider
+var fallbackProvider Provider = &OllamaProvider{}
+
+func init() {
+	registerProvider(&OpenAIProvider{})
+	registerProvider(&GeminiProvider{})
+}
+
+// register a provider, to add a new backend implement Provider and register it here
+func registerProvider(p Provider) {
+	providers = append(providers, p)
+}
+
+// get the provider that serves the model, as recorded in the model catalog
+func getProvider(c context.Context, model string) Provider {
+	name := catalog.Lookup(c, model).Provider
+	for _, p := range providers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return fallbackProvider
+}
+
+// OpenAI models, mapped to the names used by the OpenAI API. Other OpenAI
+// models can be added in the config.
+type OpenAIProvider struct{}
+
+var openaiModels = []struct {
+	name          string
+	id            string
+	vision        bool
+	contextWindow int
+}{
+	{"gpt-3.5-turbo", "gpt-3.5-turbo", false, 4096},
+	{"gpt-4", "gpt-4", false, 8192},
+	{"gpt-4-turbo", "gpt-4-1106-preview", false, 128000},
+	{"gpt-4-vision", "gpt-4-vision-preview", true, 128000},
+}
+
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *OpenAIProvider) Models(c context.Context) ([]ModelInfo, error) {
+	results := []ModelInfo{}
+	for _, m := range openaiModels {
+		results = append(results, ModelInfo{
+			Name:          m.name,
+			Provider:      p.Name(),
+			Vision:        m.vision,
+			JSON:          !m.vision,
+			ContextWindow: m.contextWindow,
+		})
+	}
+	return results, nil
+}
+
+func (p *OpenAIProvider) Predict(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
+	return gpt(c, out, p.id(model), prompt, ctx, format)
+}
+
+func (p *OpenAIProvider) Chat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error) {
+	return gptChat(c, out, p.id(model), prompt, conv)
+}
+
+func (p *OpenAIProvider) PredictImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error) {
+	return gptImage(c, out, p.id(model), prompt, ctx, images)
+}
+
+// get the OpenAI API name for the model
+func (p *OpenAIProvider) id(model string) string {
+	for _, m := range openaiModels {
+		if m.name == model {
+			return m.id
+		}
+	}
+	return model
+}
+
+// Google Gemini models
+type GeminiProvider struct{}
+
+func (p *GeminiProvider) Name() string {
+	return "gemini"
+}
+
+func (p *GeminiProvider) Models(c context.Context) ([]ModelInfo, error) {
+	return []ModelInfo{
+		{Name: "gemini-pro", Provider: p.Name(), ContextWindow: 30720},
+		{Name: "gemini-pro-vision", Provider: p.Name(), Vision: true, ContextWindow: 12288},
+	}, nil
+}
+
+func (p *GeminiProvider) Predict(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
+	return gemini(c, out, model, prompt, ctx, format)
+}
+
+func (p *GeminiProvider) Chat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error) {
+	return geminiChat(c, out, model, prompt, conv)
+}
+
+func (p *GeminiProvider) PredictImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error) {
+	return geminiImage(c, out, model, prompt, ctx, images)
+}
+
+// local models served by the embedded Ollama server
+type OllamaProvider struct{}
+
+func (p *OllamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *OllamaProvider) Models(c context.Context) ([]ModelInfo, error) {
+	models := &Models{}
+	req, err := http.NewRequestWithContext(c, http.MethodGet, cfg.ollamaURL()+"/api/tags", nil)
+	if err != nil {
+		return []ModelInfo{}, err
+	}
+	client := http.Client{Timeout: cfg.Timeouts.Request}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("err in calling ollama:", err)
+		return []ModelInfo{}, err
+	}
+	defer httpResp.Body.Close()
+	decoder := json.NewDecoder(httpResp.Body)
+	err = decoder.Decode(models)
+	if err != nil {
+		fmt.Println("err in getting models:", err)
+		return []ModelInfo{}, err
+	}
+	results := []ModelInfo{}
+	for _, m := range models.Models {
+		info, err := ollamaShow(c, m.Name)
+		if err != nil {
+			fmt.Println("err in getting model details:", err)
+			info = ModelInfo{Name: m.Name, Provider: p.Name(), JSON: true, ContextWindow: defaultContextWindow}
+		}
+		results = append(results, info)
+	}
+	return results, nil
+}
+
+func (p *OllamaProvider) Predict(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
+	return ollama(c, out, model, prompt, ctx, format)
+}
+
+func (p *OllamaProvider) Chat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error) {
+	return ollamaChat(c, out, model, prompt, conv)
+}
+
+func (p *OllamaProvider) PredictImage(c context.Context, out Sink, model string, prompt string, ctx string, images []string) (string, error) {
+	return ollamaImage(c, out, model, prompt, ctx, images)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Research is a report on a question, written from several searches
+type Research struct {
+	Question string
+	Model    string
+	// queries searched, in order
+	Queries []string
+	// pages read, cited as [1] for the first one
+	Sources []Page
+	Report  string
+	Time    time.Time
+}
+
+// queries planned by the model, and whether it has enough to write the report
+type researchPlan struct {
+	Done    bool     `json:"done"`
+	Queries []string `json:"queries"`
+}
+
+// research a question by searching for the sub-questions planned by the
+// model, reading the pages found and searching again until the model has
+// enough to answer or the budget is used up, then write a cited report to
+// the sink. The filters in the search options are used for every search.
+// Progress is reported to status.
+func research(c context.Context, out Sink, model string, question string, opts SearchOptions, status func(string)) (*Research, error) {
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	e, err := getEngine(opts.Engine)
+	if err != nil {
+		return nil, err
+	}
+	r := &Research{Question: question, Model: model, Time: time.Now()}
+
+	status("planning")
+	ctx, err := json.Marshal(map[string]string{"question": question})
+	if err != nil {
+		return nil, err
+	}
+	plan, err := r.plan(c, cfg.Prompts.Plan, string(ctx))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for round := 1; round <= cfg.Research.Rounds && !plan.Done; round++ {
+		queries := plan.Queries
+		if len(queries) > cfg.Research.Queries {
+			queries = queries[:cfg.Research.Queries]
+		}
+		for _, query := range queries {
+			if len(r.Sources) >= cfg.Research.Sources {
+				break
+			}
+			status("searching for " + query)
+			results, err := cachedSearch(c, e, query, opts)
+			if err != nil {
+				if c.Err() != nil {
+					return nil, c.Err()
+				}
+				fmt.Println("err in searching:", err)
+				continue
+			}
+			r.Queries = append(r.Queries, query)
+			found := []SearchResult{}
+			for _, result := range results {
+				if !seen[result.Url] && len(r.Sources)+len(found) < cfg.Research.Sources {
+					seen[result.Url] = true
+					found = append(found, result)
+				}
+			}
+			status(fmt.Sprintf("reading %d pages", min(len(found), cfg.Search.Pages)))
+			r.Sources = append(r.Sources, fetchPages(c, found, cfg.Search.Pages, opts.Fresh)...)
+		}
+		if round == cfg.Research.Rounds || len(r.Sources) >= cfg.Research.Sources {
+			break
+		}
+		status("reviewing what has been found")
+		plan, err = r.plan(c, cfg.Prompts.Review, r.context(excerptLength(c, model, len(r.Sources))))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.Err() != nil {
+		return nil, c.Err()
+	}
+
+	status(fmt.Sprintf("writing the report from %d sources", len(r.Sources)))
+	sink := &citeSink{Sink: out}
+	report, err := predict(c, sink, model, cfg.Prompts.Report, r.context(excerptLength(c, model, len(r.Sources))), "")
+	if err != nil {
+		return nil, err
+	}
+	r.Report = report
+	footer := checkCitations(report, r.results()).Footer()
+	err = out.Token(footer)
+	out.Done(sink.stats)
+	return r, err
+}
+
+// ask the model to plan the queries to search, if the model does not respond
+// with a plan, or is done before searching, the question is searched as it is
+func (r *Research) plan(c context.Context, prompt string, ctx string) (researchPlan, error) {
+	plan := researchPlan{}
+	answer, err := predict(c, &FuncSink{}, r.Model, prompt, ctx, "json")
+	if err != nil {
+		return plan, err
+	}
+	err = json.Unmarshal([]byte(answer), &plan)
+	if err != nil {
+		fmt.Println("err in reading research plan:", err)
+	}
+	// there is always at least one round of searches before the model is
+	// asked if it has enough to answer
+	if len(r.Queries) == 0 {
+		plan.Done = false
+		if len(plan.Queries) == 0 {
+			plan.Queries = []string{r.Question}
+		}
+	}
+	// do not search the same query twice
+	queries := []string{}
+	for _, q := range plan.Queries {
+		q = strings.TrimSpace(q)
+		if q != "" && !contains(r.Queries, q) && !contains(queries, q) {
+			queries = append(queries, q)
+		}
+	}
+	plan.Queries = queries
+	if len(queries) == 0 {
+		plan.Done = true
+	}
+	return plan, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// the question, queries searched and the pages read, for the prompt
+func (r *Research) context(n int) string {
+	// strings always marshal
+	ctx, _ := json.MarshalIndent(struct {
+		Question     string   `json:"question"`
+		Queries      []string `json:"queries"`
+		SearchResult string   `json:"search_result"`
+	}{r.Question, r.Queries, formatPages(r.Sources, n)}, "", "\t")
+	return string(ctx)
+}
+
+func (r *Research) results() []SearchResult {
+	results := []SearchResult{}
+	for _, page := range r.Sources {
+		results = append(results, page.SearchResult)
+	}
+	return results
+}
+
+// the report as markdown, with the sources cited
+func (r *Research) Markdown() string {
+	md := fmt.Sprintf("# %s\n\n", r.Question)
+	md += fmt.Sprintf("_Researched with %s on %s, searching for %s._\n\n", r.Model,
+		r.Time.Format("2 Jan 2006"), strings.Join(r.Queries, "; "))
+	md += strings.TrimSpace(r.Report) + "\n"
+	citations := checkCitations(r.Report, r.results())
+	if len(citations.Cited) > 0 {
+		md += "\n## Sources\n\n"
+		for _, n := range citations.Cited {
+			source := r.Sources[n-1]
+			md += fmt.Sprintf("- [%d] [%s](%s)\n", n, strings.TrimSpace(source.Title), source.Url)
+		}
+	}
+	return md
+}
+
+// save the report as a markdown file
+func (r *Research) Save(file string) error {
+	return os.WriteFile(file, []byte(r.Markdown()), 0o644)
+}
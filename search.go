@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// SearchEngine searches the Internet, or anything else that returns results
+type SearchEngine interface {
+	// name of the engine, used to select it in the config or per query
+	Name() string
+	// search for the query and return the top results, engines apply the
+	// filters in the options that they support
+	Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error)
+}
+
+// SearchOptions are the options for a search
+type SearchOptions struct {
+	// search engine to use, the one in the config if empty
+	Engine string `json:"engine" form:"engine"`
+	// rewrite the question into keyword queries before searching
+	Rewrite bool `json:"rewrite" form:"rewrite"`
+	// only search this site, e.g. gov.sg
+	Site string `json:"site" form:"site"`
+	// only search for files of this type, e.g. pdf
+	FileType string `json:"filetype" form:"filetype"`
+	// country to search in, with an optional language, e.g. sg or de-de
+	Region string `json:"region" form:"region"`
+	// only search pages from the past day, week, month or year
+	Time string `json:"time" form:"time"`
+	// do not use the cached search results and pages
+	Fresh bool `json:"fresh" form:"fresh"`
+}
+
+// add the search options flags to a flag set
+func (o *SearchOptions) AddFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Engine, "engine", cfg.Search.Engine, "search engine to use")
+	flags.BoolVar(&o.Rewrite, "rewrite", cfg.Search.Rewrite, "rewrite the question into keyword queries")
+	flags.StringVar(&o.Site, "site", "", "only search this site")
+	flags.StringVar(&o.FileType, "filetype", "", "only search for files of this type")
+	flags.StringVar(&o.Region, "region", "", "country to search in, e.g. sg or de-de")
+	flags.StringVar(&o.Time, "time", "", "only search pages from the past day, week, month or year")
+	flags.BoolVar(&o.Fresh, "fresh", false, "do not use the cached search results and pages")
+}
+
+// check the options are valid
+func (o SearchOptions) Validate() error {
+	_, err := getEngine(o.Engine)
+	if err != nil {
+		return err
+	}
+	switch o.Time {
+	case "", "day", "week", "month", "year":
+	default:
+		return fmt.Errorf("time must be day, week, month or year, not %s", o.Time)
+	}
+	if o.Region != "" && !regionPattern.MatchString(o.Region) {
+		return fmt.Errorf("region must be a country code with an optional language, e.g. sg or de-de, not %s", o.Region)
+	}
+	return nil
+}
+
+var regionPattern = regexp.MustCompile(`^[a-zA-Z]{2}(-[a-zA-Z]{2})?$`)
+
+// add the site: and filetype: operators to the query
+func (o SearchOptions) Query(query string) string {
+	if o.Site != "" {
+		query += " site:" + o.Site
+	}
+	if o.FileType != "" {
+		query += " filetype:" + o.FileType
+	}
+	return query
+}
+
+// country code of the region in lower case, e.g. sg
+func (o SearchOptions) country() string {
+	return strings.ToLower(strings.Split(o.Region, "-")[0])
+}
+
+// language of the region in lower case, English if it is not given
+func (o SearchOptions) language() string {
+	parts := strings.Split(o.Region, "-")
+	if len(parts) < 2 {
+		return "en"
+	}
+	return strings.ToLower(parts[1])
+}
+
+// registered search engines
+var engines []SearchEngine
+
+func init() {
+	registerEngine(&DuckDuckGo{})
+	registerEngine(&SearXNG{})
+	registerEngine(&Brave{})
+	registerEngine(&Bing{})
+	registerEngine(&Fixture{})
+}
+
+// register a search engine, to add a new engine implement SearchEngine and
+// register it here
+func registerEngine(e SearchEngine) {
+	engines = append(engines, e)
+}
+
+// get a search engine by name, or the one in the config if name is empty
+func getEngine(name string) (SearchEngine, error) {
+	if name == "" {
+		name = cfg.Search.Engine
+	}
+	for _, e := range engines {
+		if e.Name() == name {
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown search engine %s, use one of %s", name, strings.Join(engineNames(), ", "))
+}
+
+// names of the registered search engines
+func engineNames() []string {
+	names := []string{}
+	for _, e := range engines {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// most keyword queries a question is rewritten into
+const maxRewrites = 3
+
+// ask the model to rewrite a question into keyword queries for a search
+// engine, the question is used as it is if the model cannot rewrite it
+func rewriteQuery(c context.Context, model string, question string) []string {
+	ctx, err := json.Marshal(struct {
+		Question string `json:"question"`
+	}{question})
+	if err != nil {
+		return []string{question}
+	}
+	answer, err := predict(c, &FuncSink{}, model, cfg.Prompts.Rewrite, string(ctx), "json")
+	if err != nil {
+		fmt.Println("err in rewriting query:", err)
+		return []string{question}
+	}
+	rewrite := struct {
+		Queries []string `json:"queries"`
+	}{}
+	err = json.Unmarshal([]byte(answer), &rewrite)
+	if err != nil {
+		fmt.Println("err in reading rewritten queries:", err)
+		return []string{question}
+	}
+	queries := []string{}
+	for _, q := range rewrite.Queries {
+		if q = strings.TrimSpace(q); q != "" && len(queries) < maxRewrites {
+			queries = append(queries, q)
+		}
+	}
+	if len(queries) == 0 {
+		return []string{question}
+	}
+	return queries
+}
+
+// search for each of the queries and merge the results, taking the top
+// result of each query in turn, results are only returned once
+func searchAll(c context.Context, queries []string, opts SearchOptions) ([]SearchResult, error) {
+	e, err := getEngine(opts.Engine)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	lists := [][]SearchResult{}
+	for _, query := range queries {
+		results, err := cachedSearch(c, e, query, opts)
+		if err != nil {
+			// only fail if none of the queries can be searched
+			if len(queries) == 1 || c.Err() != nil {
+				return []SearchResult{}, err
+			}
+			fmt.Println("err in searching:", err)
+			continue
+		}
+		lists = append(lists, results)
+	}
+	if len(lists) == 0 {
+		return []SearchResult{}, fmt.Errorf("cannot search for any of %s", strings.Join(queries, "; "))
+	}
+
+	merged := []SearchResult{}
+	seen := map[string]bool{}
+	for i := 0; len(merged) < cfg.Search.Results; i++ {
+		more := false
+		for _, results := range lists {
+			if i >= len(results) {
+				continue
+			}
+			more = true
+			if !seen[results[i].Url] && len(merged) < cfg.Search.Results {
+				seen[results[i].Url] = true
+				merged = append(merged, results[i])
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return merged, nil
+}
+
+// get a URL with the headers given and decode the JSON response into v
+func getJSON(c context.Context, queryURL string, headers map[string]string, v any) error {
+	client := &http.Client{Timeout: cfg.Timeouts.Request}
+	request, err := http.NewRequestWithContext(c, "GET", queryURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	for k, h := range headers {
+		request.Header.Set(k, h)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("status is %d", response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// DuckDuckGo scrapes the DuckDuckGo HTML search page
+type DuckDuckGo struct{}
+
+func (e *DuckDuckGo) Name() string {
+	return "duckduckgo"
+}
+
+func (e *DuckDuckGo) Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	queryURL := fmt.Sprintf("https://html.duckduckgo.com/html/?q=%s", url.QueryEscape(opts.Query(query)))
+	if opts.Region != "" {
+		queryURL += "&kl=" + opts.country() + "-" + opts.language()
+	}
+	if opts.Time != "" {
+		queryURL += "&df=" + opts.Time[:1]
+	}
+	client := &http.Client{Timeout: cfg.Timeouts.Request}
+	request, err := http.NewRequestWithContext(c, "GET", queryURL, nil)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	request.Header.Set("User-Agent", cfg.Search.UserAgent)
+	response, err := client.Do(request)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return []SearchResult{}, fmt.Errorf("status is %d", response.StatusCode)
+	}
+
+	doc, err := goquery.NewDocumentFromReader(response.Body)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+
+	results := []SearchResult{}
+	sel := doc.Find(".web-result")
+	for i := range sel.Nodes {
+		if len(results) >= cfg.Search.Results {
+			break
+		}
+
+		node := sel.Eq(i)
+		titleNode := node.Find(".result__a")
+		info := node.Find(".result__snippet").Text()
+		title := titleNode.Text()
+		href, _ := titleNode.Attr("href")
+		results = append(results, SearchResult{title, info, ddgURL(href)})
+	}
+	return results, nil
+}
+
+// SearXNG uses the JSON API of a self-hosted SearXNG instance, the instance
+// must have the json format enabled
+type SearXNG struct{}
+
+func (e *SearXNG) Name() string {
+	return "searxng"
+}
+
+func (e *SearXNG) Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	if cfg.Search.SearXNG.URL == "" {
+		return []SearchResult{}, fmt.Errorf("search.searxng.url is not set")
+	}
+	queryURL := strings.TrimSuffix(cfg.Search.SearXNG.URL, "/") + "/search?format=json&q=" + url.QueryEscape(opts.Query(query))
+	if opts.Region != "" {
+		queryURL += "&language=" + opts.language() + "-" + strings.ToUpper(opts.country())
+	}
+	if opts.Time != "" {
+		queryURL += "&time_range=" + opts.Time
+	}
+	resp := struct {
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+	}{}
+	err := getJSON(c, queryURL, nil, &resp)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	results := []SearchResult{}
+	for _, r := range resp.Results {
+		if len(results) >= cfg.Search.Results {
+			break
+		}
+		results = append(results, SearchResult{r.Title, r.Content, r.URL})
+	}
+	return results, nil
+}
+
+// Brave uses the Brave Search API
+type Brave struct{}
+
+func (e *Brave) Name() string {
+	return "brave"
+}
+
+func (e *Brave) Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	if cfg.Search.Brave.APIKey == "" {
+		return []SearchResult{}, fmt.Errorf("search.brave.api_key is not set")
+	}
+	queryURL := "https://api.search.brave.com/res/v1/web/search?q=" + url.QueryEscape(opts.Query(query)) +
+		"&count=" + strconv.Itoa(cfg.Search.Results)
+	if opts.Region != "" {
+		queryURL += "&country=" + opts.country() + "&search_lang=" + opts.language()
+	}
+	if opts.Time != "" {
+		queryURL += "&freshness=p" + opts.Time[:1]
+	}
+	resp := struct {
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+			} `json:"results"`
+		} `json:"web"`
+	}{}
+	err := getJSON(c, queryURL, map[string]string{"X-Subscription-Token": cfg.Search.Brave.APIKey}, &resp)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	results := []SearchResult{}
+	for _, r := range resp.Web.Results {
+		if len(results) >= cfg.Search.Results {
+			break
+		}
+		results = append(results, SearchResult{r.Title, r.Description, r.URL})
+	}
+	return results, nil
+}
+
+// Bing uses the Bing Web Search API
+type Bing struct{}
+
+func (e *Bing) Name() string {
+	return "bing"
+}
+
+func (e *Bing) Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	if cfg.Search.Bing.APIKey == "" {
+		return []SearchResult{}, fmt.Errorf("search.bing.api_key is not set")
+	}
+	queryURL := "https://api.bing.microsoft.com/v7.0/search?q=" + url.QueryEscape(opts.Query(query)) +
+		"&count=" + strconv.Itoa(cfg.Search.Results)
+	if opts.Region != "" {
+		queryURL += "&mkt=" + opts.language() + "-" + strings.ToUpper(opts.country())
+	}
+	switch opts.Time {
+	case "day", "week", "month":
+		queryURL += "&freshness=" + strings.ToUpper(opts.Time[:1]) + opts.Time[1:]
+	case "year":
+		// Bing has no freshness for a year, so use a date range
+		now := time.Now()
+		queryURL += "&freshness=" + now.AddDate(-1, 0, 0).Format("2006-01-02") + ".." + now.Format("2006-01-02")
+	}
+	resp := struct {
+		WebPages struct {
+			Value []struct {
+				Name    string `json:"name"`
+				URL     string `json:"url"`
+				Snippet string `json:"snippet"`
+			} `json:"value"`
+		} `json:"webPages"`
+	}{}
+	err := getJSON(c, queryURL, map[string]string{"Ocp-Apim-Subscription-Key": cfg.Search.Bing.APIKey}, &resp)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	results := []SearchResult{}
+	for _, r := range resp.WebPages.Value {
+		if len(results) >= cfg.Search.Results {
+			break
+		}
+		results = append(results, SearchResult{r.Name, r.Snippet, r.URL})
+	}
+	return results, nil
+}
+
+// Fixture returns results from a local JSON file, for testing and working
+// offline. The file is a JSON object of queries, including any site: and
+// filetype: operators, to results. Results under "*" are returned for any
+// other query.
+type Fixture struct{}
+
+func (e *Fixture) Name() string {
+	return "fixture"
+}
+
+func (e *Fixture) Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	if cfg.Search.Fixture.File == "" {
+		return []SearchResult{}, fmt.Errorf("search.fixture.file is not set")
+	}
+	data, err := os.ReadFile(cfg.Search.Fixture.File)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	fixtures := map[string][]SearchResult{}
+	err = json.Unmarshal(data, &fixtures)
+	if err != nil {
+		return []SearchResult{}, fmt.Errorf("cannot read fixture file %s: %w", cfg.Search.Fixture.File, err)
+	}
+	results, ok := fixtures[opts.Query(query)]
+	if !ok {
+		results = fixtures["*"]
+	}
+	if len(results) > cfg.Search.Results {
+		results = results[:cfg.Search.Results]
+	}
+	return results, nil
+}
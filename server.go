@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server exposes waldo as JSON endpoints over HTTP
+type Server struct {
+	mu    sync.Mutex
+	model string
+}
+
+// request to ask or search
+type ServerRequest struct {
+	Query   string `json:"query" form:"query"`
+	Model   string `json:"model" form:"model"`
+	Session string `json:"session" form:"session"`
+	Stream  bool   `json:"stream" form:"stream"`
+	// options for searches
+	SearchOptions
+}
+
+// response to ask, search or image requests that are not streamed
+type ServerResponse struct {
+	Model   string `json:"model"`
+	Session string `json:"session,omitempty"`
+	Answer  string `json:"answer"`
+	Stats   Stats  `json:"stats"`
+}
+
+// locks for the sessions in use, so that requests on the same session
+// are processed one at a time. A lock is removed once no request is using
+// or waiting for it.
+var sessionLocks = struct {
+	sync.Mutex
+	locks map[string]*sessionLock
+}{locks: map[string]*sessionLock{}}
+
+type sessionLock struct {
+	sync.Mutex
+	// number of requests using or waiting for the lock
+	refs int
+}
+
+func lockSession(id string) func() {
+	sessionLocks.Lock()
+	l, ok := sessionLocks.locks[id]
+	if !ok {
+		l = &sessionLock{}
+		sessionLocks.locks[id] = l
+	}
+	l.refs++
+	sessionLocks.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		sessionLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(sessionLocks.locks, id)
+		}
+		sessionLocks.Unlock()
+	}
+}
+
+// start the HTTP server
+func serve(addr string) error {
+	s := &Server{model: model}
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.GET("/api/models", s.models)
+	router.POST("/api/model", s.switchModel)
+	router.POST("/api/ask", s.ask)
+	router.POST("/api/search", s.search)
+	router.POST("/api/image", s.image)
+	router.POST("/v1/chat/completions", s.chatCompletions)
+	router.GET("/v1/models", s.listModels)
+	fmt.Println(white("waldo."), cyan("serving on http://"+addr))
+	return router.Run(addr)
+}
+
+// the model to use for the request, defaults to the server's current model
+func (s *Server) modelFor(req ServerRequest) string {
+	if req.Model != "" {
+		return req.Model
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.model
+}
+
+// GET /api/models
+func (s *Server) models(c *gin.Context) {
+	models, err := catalog.Refresh(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"model": s.model, "models": models})
+}
+
+// POST /api/model
+func (s *Server) switchModel(c *gin.Context) {
+	req := ServerRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.model = req.Model
+	c.JSON(http.StatusOK, gin.H{"model": s.model})
+}
+
+// POST /api/ask
+func (s *Server) ask(c *gin.Context) {
+	req := ServerRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	session, unlock, err := s.session(req)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer unlock()
+	m := s.modelFor(req)
+	s.respond(c, req.Stream, m, session.ID, func(out Sink) (string, error) {
+		return ask(c.Request.Context(), out, session, m, req.Query, nil, nil)
+	})
+}
+
+// POST /api/search
+func (s *Server) search(c *gin.Context) {
+	req := ServerRequest{SearchOptions: SearchOptions{Rewrite: cfg.Search.Rewrite}}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	if err := req.SearchOptions.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	m := s.modelFor(req)
+	s.respond(c, req.Stream, m, "", func(out Sink) (string, error) {
+		return search(c.Request.Context(), out, m, req.Query, req.SearchOptions)
+	})
+}
+
+// POST /api/image, a multipart form with the query and one or more image files
+func (s *Server) image(c *gin.Context) {
+	req := ServerRequest{}
+	if err := c.ShouldBind(&req); err != nil || req.Query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		return
+	}
+	m := s.modelFor(req)
+	if !catalog.Lookup(c.Request.Context(), m).Vision {
+		c.JSON(http.StatusBadRequest, gin.H{"error": m + " cannot answer questions on images"})
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["images"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "one or more images are required"})
+		return
+	}
+	dir, err := os.MkdirTemp("", "waldo")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.RemoveAll(dir)
+	images := []string{}
+	for i, file := range form.File["images"] {
+		path := filepath.Join(dir, fmt.Sprintf("%d-%s", i, filepath.Base(file.Filename)))
+		if err := c.SaveUploadedFile(file, path); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		images = append(images, path)
+	}
+	session, unlock, err := s.session(req)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer unlock()
+	s.respond(c, req.Stream, m, session.ID, func(out Sink) (string, error) {
+		return askImage(c.Request.Context(), out, session, m, req.Query, images)
+	})
+}
+
+// load the session given in the request, or start a new one if the session
+// is "new". The session is locked until the returned unlock function is
+// called. Requests without a session are not saved.
+func (s *Server) session(req ServerRequest) (*Session, func(), error) {
+	switch req.Session {
+	case "":
+		session := newSession()
+		session.ID = ""
+		return session, func() {}, nil
+	case "new":
+		session := newSession()
+		return session, lockSession(session.ID), nil
+	}
+	unlock := lockSession(req.Session)
+	session, err := loadSession(req.Session)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return session, unlock, nil
+}
+
+// run the generation, either streaming the answer as Server-Sent Events or
+// responding with the whole answer once it is done
+func (s *Server) respond(c *gin.Context, stream bool, model string, sessionID string, generate func(out Sink) (string, error)) {
+	if !stream {
+		stats := Stats{}
+		answer, err := generate(&FuncSink{OnDone: func(s Stats) { stats = s }})
+		if err != nil {
+			log.Println("cannot generate answer:", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, ServerResponse{Model: model, Session: sessionID, Answer: strings.TrimSpace(answer), Stats: stats})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	_, err := generate(&sseSink{c: c, session: sessionID})
+	if err != nil {
+		log.Println("cannot generate answer:", err)
+		c.SSEvent("error", gin.H{"error": err.Error()})
+		c.Writer.Flush()
+	}
+}
+
+// sseSink sends each chunk as a Server-Sent Event, and the stats when done
+type sseSink struct {
+	c       *gin.Context
+	session string
+}
+
+func (s *sseSink) Token(chunk string) error {
+	s.c.SSEvent("token", chunk)
+	s.c.Writer.Flush()
+	return s.c.Request.Context().Err()
+}
+
+func (s *sseSink) Done(stats Stats) {
+	s.c.SSEvent("done", gin.H{"model": stats.Model, "session": s.session, "stats": stats})
+	s.c.Writer.Flush()
+}
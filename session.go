@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Session is a conversation that is saved to disk and can be resumed later
+type Session struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Model     string    `json:"model"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Turns     []Turn    `json:"turns"`
+}
+
+// Turn is a single question and answer in a session
+type Turn struct {
+	Model  string   `json:"model"`
+	Prompt string   `json:"prompt"`
+	Answer string   `json:"answer"`
+	Images []string `json:"images,omitempty"`
+	Files  []string `json:"files,omitempty"`
+	// shell command whose output was given with the prompt
+	Command  string        `json:"command,omitempty"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+}
+
+// the current session
+var session = newSession()
+
+// create a new session, it is only written to disk after the first turn
+func newSession() *Session {
+	now := time.Now()
+	return &Session{
+		ID:        sessionID(now),
+		Model:     model,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Turns:     []Turn{},
+	}
+}
+
+// the session ID is the time it was created with a random suffix, so that
+// sessions created in the same second, e.g. by the server, are not mixed up
+func sessionID(t time.Time) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return t.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// session IDs are the time the session was created, with a random suffix for
+// the sessions created since the suffix was added
+var sessionIDPattern = regexp.MustCompile(`^\d{8}-\d{6}(-[0-9a-f]+)?$`)
+
+// check the session ID before using it as a file name, so that IDs from
+// requests cannot name files outside the sessions directory
+func checkSessionID(id string) error {
+	if !sessionIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid session id %q", id)
+	}
+	return nil
+}
+
+// directory where the sessions are stored
+func sessionsDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".waldo", "sessions"), nil
+}
+
+// the conversation so far in the session
+func (s *Session) Conversation() *Conversation {
+	conv := &Conversation{}
+	for _, turn := range s.Turns {
+		conv.Add("user", turn.Prompt)
+		conv.Add("assistant", turn.Answer)
+	}
+	return conv
+}
+
+// add a turn to the session and save it, sessions without an ID are not saved
+func (s *Session) AddTurn(turn Turn) error {
+	s.Turns = append(s.Turns, turn)
+	s.Model = turn.Model
+	s.UpdatedAt = turn.Time.Add(turn.Duration)
+	if s.Name == "" {
+		s.Name = summarize(turn.Prompt, 40)
+	}
+	if s.ID == "" {
+		return nil
+	}
+	return s.Save()
+}
+
+// save the session to disk
+func (s *Session) Save() error {
+	err := checkSessionID(s.ID)
+	if err != nil {
+		return err
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create sessions directory %w", err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, s.ID+".json"), data, 0o644)
+}
+
+// load a saved session
+func loadSession(id string) (*Session, error) {
+	err := checkSessionID(id)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no such session %s", id)
+		}
+		return nil, err
+	}
+	s := &Session{}
+	err = json.Unmarshal(data, s)
+	// the session is saved to the file it was loaded from
+	s.ID = id
+	return s, err
+}
+
+// list the saved sessions, most recently updated first
+func listSessions() ([]*Session, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*Session{}
+	for _, file := range files {
+		s, err := loadSession(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			fmt.Println("cannot load session:", err)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+	return sessions, nil
+}
+
+// delete a saved session
+func deleteSession(id string) error {
+	err := checkSessionID(id)
+	if err != nil {
+		return err
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no such session %s", id)
+	}
+	return err
+}
+
+// one line description of a session
+func (s *Session) String() string {
+	return fmt.Sprintf("%s  %s (%s, %d turns)", s.ID, s.Name, s.Model, len(s.Turns))
+}
+
+// shorten text to a single line of at most n characters
+func summarize(text string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+	return string(runes)
+}
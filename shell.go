@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Shell runs command lines with an embedded POSIX shell interpreter, which
+// keeps the working directory and variables from one command line to the
+// next
+type Shell struct {
+	runner *interp.Runner
+	// the last command run and its output
+	Last *ShellOutput
+}
+
+// ShellOutput is a command run in the shell with the output it wrote
+type ShellOutput struct {
+	Command string
+	Output  string
+	Status  int
+}
+
+// the shell used to run commands, started when the first command is run
+var sh *Shell
+
+func newShell() (*Shell, error) {
+	runner, err := interp.New(interp.ExecHandlers(checkExec, execProcessGroup))
+	if err != nil {
+		return nil, err
+	}
+	return &Shell{runner: runner}, nil
+}
+
+// parse a command line, with bash syntax
+func parseCommand(line string) (*syntax.File, error) {
+	file, err := syntax.NewParser().Parse(strings.NewReader(line), "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse command: %w", err)
+	}
+	return file, nil
+}
+
+// run the parsed command line, writing its output and error output as it
+// runs, returns everything it wrote
+func (s *Shell) Run(c context.Context, file *syntax.File, stdout io.Writer, stderr io.Writer) ([]byte, error) {
+	out := &lockedBuffer{}
+	err := interp.StdIO(nil, io.MultiWriter(stdout, out), io.MultiWriter(stderr, out))(s.runner)
+	if err != nil {
+		return nil, err
+	}
+	err = s.runner.Run(c, file)
+	return out.Bytes(), err
+}
+
+// the working directory of the shell
+func (s *Shell) Dir() string {
+	return s.runner.Dir
+}
+
+// key of the function that confirms the programs the shell runs, in the
+// context the command line is run with
+type confirmKey struct{}
+
+// the context with the function that confirms the programs the shell runs
+func withConfirm(c context.Context, confirm func(string) bool) context.Context {
+	return context.WithValue(c, confirmKey{}, confirm)
+}
+
+// check each program the shell runs against the policy, after the variables
+// and globs in the command line have been expanded, so that programs that are
+// not in the command line as typed are checked too. Programs the policy wants
+// confirmed are not run unless the confirm function in the context returns
+// true.
+func checkExec(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(c context.Context, args []string) error {
+		hc := interp.HandlerCtx(c)
+		stderr := hc.Stderr
+		policy, err := commandPolicy()
+		if err == nil {
+			err = policy.CheckProgram(hc.Dir, args)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return interp.NewExitStatus(126)
+		}
+		line := shellWords(args)
+		ask, err := policy.confirm(line)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return interp.NewExitStatus(126)
+		}
+		if ask {
+			confirm, ok := c.Value(confirmKey{}).(func(string) bool)
+			if !ok || confirm == nil {
+				fmt.Fprintln(stderr, line, "needs to be confirmed, not run")
+				return interp.NewExitStatus(126)
+			}
+			if !confirm(line) {
+				fmt.Fprintln(stderr, line, "not run")
+				return interp.NewExitStatus(126)
+			}
+		}
+		return next(c, args)
+	}
+}
+
+// the command and its output for the prompt, with at most n characters of
+// the output
+func (o *ShellOutput) Format(n int) string {
+	return fmt.Sprintf("$ %s\n%s\n(exit status %d)\n\n", o.Command, truncateOutput(stripANSI(o.Output), n), o.Status)
+}
+
+// shorten the output of a command to about n characters, keeping whole lines
+// from the start and more from the end, where the errors and summaries
+// usually are
+func truncateOutput(output string, n int) string {
+	output = strings.TrimRight(output, "\n")
+	if len(output) <= n {
+		return output
+	}
+	lines := strings.Split(output, "\n")
+	head, tail := []string{}, []string{}
+	length := 0
+	for _, line := range lines {
+		if length+len(line)+1 > n/4 {
+			break
+		}
+		head = append(head, line)
+		length += len(line) + 1
+	}
+	for i := len(lines) - 1; i >= len(head); i-- {
+		if length+len(lines[i])+1 > n {
+			break
+		}
+		tail = append([]string{lines[i]}, tail...)
+		length += len(lines[i]) + 1
+	}
+	// a single line longer than n is cut
+	if len(head) == 0 && len(tail) == 0 {
+		return "[...]" + output[len(output)-n:]
+	}
+	left := len(lines) - len(head) - len(tail)
+	return strings.Join(head, "\n") + fmt.Sprintf("\n[... %d lines left out ...]\n", left) + strings.Join(tail, "\n")
+}
+
+// colors and other terminal escape codes
+var ansiCodes = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+
+func stripANSI(text string) string {
+	return ansiCodes.ReplaceAllString(text, "")
+}
+
+// words that need no quoting in a command line
+var plainWord = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// the arguments of a command as a command line, shell words with spaces or
+// other shell characters in them are quoted again
+func shellWords(args []string) string {
+	words := []string{}
+	for _, arg := range args {
+		if !plainWord.MatchString(arg) {
+			if quoted, err := syntax.Quote(arg, syntax.LangBash); err == nil {
+				arg = quoted
+			}
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// time given to a program to stop after it is interrupted, before it is
+// killed
+const killTimeout = 2 * time.Second
+
+// run each program in its own process group instead of using the default
+// handler, so that when the command is cancelled with Ctrl-C or times out,
+// the program and the processes it started are interrupted, and killed if
+// they do not stop
+func execProcessGroup(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(c context.Context, args []string) error {
+		hc := interp.HandlerCtx(c)
+		path, err := interp.LookPathDir(hc.Dir, hc.Env, args[0])
+		if err != nil {
+			fmt.Fprintln(hc.Stderr, err)
+			return interp.NewExitStatus(127)
+		}
+		cmd := &exec.Cmd{
+			Path:   path,
+			Args:   args,
+			Env:    exportedEnv(hc.Env),
+			Dir:    hc.Dir,
+			Stdin:  hc.Stdin,
+			Stdout: hc.Stdout,
+			Stderr: hc.Stderr,
+		}
+		setProcessGroup(cmd)
+		err = cmd.Start()
+		if err != nil {
+			fmt.Fprintln(hc.Stderr, err)
+			return interp.NewExitStatus(127)
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-done:
+				return
+			case <-c.Done():
+			}
+			signalProcessGroup(cmd, false)
+			select {
+			case <-done:
+			case <-time.After(killTimeout):
+				signalProcessGroup(cmd, true)
+			}
+		}()
+		err = cmd.Wait()
+		if c.Err() != nil {
+			return c.Err()
+		}
+		exitErr := &exec.ExitError{}
+		if errors.As(err, &exitErr) {
+			if exitErr.ExitCode() < 0 {
+				// stopped by a signal
+				return interp.NewExitStatus(1)
+			}
+			return interp.NewExitStatus(uint8(exitErr.ExitCode()))
+		}
+		return err
+	}
+}
+
+// the exported variables, for the environment of a program
+func exportedEnv(env expand.Environ) []string {
+	list := []string{}
+	env.Each(func(name string, v expand.Variable) bool {
+		if v.IsSet() && v.Exported && v.Kind == expand.String {
+			list = append(list, name+"="+v.String())
+		}
+		return true
+	})
+	return list
+}
+
+// lockedBuffer is a buffer that programs can write their output and error
+// output to at the same time
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// colorWriter colors everything written to it
+type colorWriter struct {
+	w     io.Writer
+	color func(a ...interface{}) string
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(c.w, c.color(string(p)))
+	return len(p), err
+}
+
+// the programs run by the command line as typed, leaving out the shell
+// builtins and the programs that are only known once the command line is
+// expanded
+func commandNames(file *syntax.File) []string {
+	names := []string{}
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 {
+			if name := call.Args[0].Lit(); name != "" && !shellBuiltins[name] {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// builtins of the shell interpreter, the programs they run are checked when
+// they are run
+var shellBuiltins = map[string]bool{
+	"true": true, ":": true, "false": true, "exit": true, "set": true, "shift": true, "unset": true,
+	"echo": true, "printf": true, "break": true, "continue": true, "pwd": true, "cd": true,
+	"wait": true, "builtin": true, "trap": true, "type": true, "source": true, ".": true, "command": true,
+	"dirs": true, "pushd": true, "popd": true, "umask": true, "alias": true, "unalias": true,
+	"fg": true, "bg": true, "getopts": true, "eval": true, "test": true, "[": true, "exec": true,
+	"return": true, "read": true, "mapfile": true, "readarray": true, "shopt": true,
+	"export": true, "local": true, "declare": true, "readonly": true,
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hako/durafmt"
+)
+
+// Sink receives the answer from a model as it is being generated
+type Sink interface {
+	// receives each chunk of the answer, returning an error stops the generation
+	Token(chunk string) error
+	// called once with the stats when the answer is complete
+	Done(stats Stats)
+}
+
+// Stats about a generated answer
+type Stats struct {
+	Model            string        `json:"model"`
+	Duration         time.Duration `json:"duration"`
+	PromptTokens     int           `json:"prompt_tokens,omitempty"`
+	CompletionTokens int           `json:"completion_tokens,omitempty"`
+}
+
+// WriterSink writes the answer to a writer, followed by the time taken if
+// ShowStats is set or just a new line if not
+type WriterSink struct {
+	W         io.Writer
+	ShowStats bool
+}
+
+// sink that writes to the terminal
+func terminalSink() Sink {
+	return &WriterSink{W: os.Stdout, ShowStats: true}
+}
+
+func (s *WriterSink) Token(chunk string) error {
+	_, err := io.WriteString(s.W, chunk)
+	return err
+}
+
+func (s *WriterSink) Done(stats Stats) {
+	if s.ShowStats {
+		elapsed := durafmt.Parse(stats.Duration).LimitFirstN(2)
+		fmt.Fprintf(s.W, cyan("\n\n(%s)\n"), elapsed)
+		return
+	}
+	fmt.Fprintln(s.W)
+}
+
+// FuncSink calls the given functions for each chunk and when the answer is
+// complete, either can be nil
+type FuncSink struct {
+	OnToken func(chunk string) error
+	OnDone  func(stats Stats)
+}
+
+func (s *FuncSink) Token(chunk string) error {
+	if s.OnToken == nil {
+		return nil
+	}
+	return s.OnToken(chunk)
+}
+
+func (s *FuncSink) Done(stats Stats) {
+	if s.OnDone != nil {
+		s.OnDone(stats)
+	}
+}
+
+// stream forwards the chunks from a provider to a sink while collecting the
+// whole answer and timing it
+type stream struct {
+	sink   Sink
+	model  string
+	t0     time.Time
+	answer strings.Builder
+}
+
+func newStream(sink Sink, model string) *stream {
+	return &stream{sink: sink, model: model, t0: time.Now()}
+}
+
+func (s *stream) Token(chunk string) error {
+	s.answer.WriteString(chunk)
+	return s.sink.Token(chunk)
+}
+
+// complete the stream, returns the whole answer
+func (s *stream) Done(stats Stats) string {
+	stats.Model = s.model
+	stats.Duration = time.Since(s.t0)
+	s.sink.Done(stats)
+	return s.answer.String()
+}
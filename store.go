@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VectorStore is a file-backed store of the embedded chunks of documents
+type VectorStore struct {
+	path string
+	// model used to embed the chunks, all chunks are embedded again if it
+	// changes
+	Model     string               `json:"model"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	Documents map[string]*Document `json:"documents"`
+}
+
+// Document is a file in the store, with its metadata and chunks
+type Document struct {
+	Path string `json:"path"`
+	// directory the document was indexed from
+	Root string `json:"root"`
+	// type of the document, the file extension without the dot, e.g. md
+	Type    string    `json:"type"`
+	Tags    []string  `json:"tags,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	// SHA-256 hash of the content
+	Hash   string  `json:"hash"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Match is a chunk found in a search of the store
+type Match struct {
+	Document *Document
+	Chunk    Chunk
+	Score    float64
+}
+
+// Filter limits a search to the documents that match all the fields set
+type Filter struct {
+	// path or directory of the documents, relative to the directory indexed
+	// or absolute, or a glob pattern like notes/*.md
+	Path string
+	// type of the documents, e.g. md
+	Type string
+	// tags that the documents must all have
+	Tags []string
+}
+
+// add the filter flags to a flag set
+func (f *Filter) AddFlags(flags *flag.FlagSet) {
+	flags.StringVar(&f.Path, "path", "", "only use documents in this path, e.g. notes/*.md")
+	flags.StringVar(&f.Type, "type", "", "only use documents of this type, e.g. md")
+	flags.Var((*files)(&f.Tags), "tag", "only use documents with this tag, can be given more than once")
+}
+
+// counts of the documents changed by an update
+type UpdateStats struct {
+	Added     int
+	Updated   int
+	Unchanged int
+	Removed   int
+}
+
+func (u UpdateStats) String() string {
+	return fmt.Sprintf("%d added, %d updated, %d unchanged, %d removed", u.Added, u.Updated, u.Unchanged, u.Removed)
+}
+
+// file where the store is kept
+func storePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".waldo", "index.json"), nil
+}
+
+// open the store, an empty store is returned if it does not exist yet
+func openStore() (*VectorStore, error) {
+	path, err := storePath()
+	if err != nil {
+		return nil, err
+	}
+	s := &VectorStore{path: path, Model: cfg.Docs.EmbedModel, Documents: map[string]*Document{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index %s: %w", path, err)
+	}
+	if s.Documents == nil {
+		s.Documents = map[string]*Document{}
+	}
+	return s, nil
+}
+
+// save the store, writing to a temporary file first so that the store is
+// not lost if saving fails
+func (s *VectorStore) Save() error {
+	err := os.MkdirAll(filepath.Dir(s.path), 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create index directory %w", err)
+	}
+	s.UpdatedAt = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// number of chunks in the store
+func (s *VectorStore) Len() int {
+	n := 0
+	for _, doc := range s.Documents {
+		n += len(doc.Chunks)
+	}
+	return n
+}
+
+// update the store with the documents in the directory, only embedding the
+// documents that are new or have changed since they were last indexed, and
+// removing the documents that no longer exist. Each document embedded is
+// reported to status. The store is saved even if the update fails, keeping
+// the documents indexed so far.
+func (s *VectorStore) Update(c context.Context, root string, status func(string)) (UpdateStats, error) {
+	stats := UpdateStats{}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return stats, err
+	}
+	// embeddings from different models cannot be compared
+	if s.Model != cfg.Docs.EmbedModel {
+		s.Model = cfg.Docs.EmbedModel
+		s.Documents = map[string]*Document{}
+	}
+
+	found := map[string]bool{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(d.Name(), ".") || d.Name() == "vendor" || d.Name() == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !documentTypes[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		found[path] = true
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		doc, ok := s.Documents[path]
+		if ok && doc.ModTime.Equal(info.ModTime()) && doc.Size == info.Size() {
+			stats.Unchanged++
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Println("err in reading document:", err)
+			return nil
+		}
+		hash := sha256.Sum256(data)
+		if ok && doc.Hash == hex.EncodeToString(hash[:]) {
+			// touched but not changed
+			doc.ModTime, doc.Size = info.ModTime(), info.Size()
+			stats.Unchanged++
+			return nil
+		}
+
+		status(path)
+		sections, tags, err := readDocument(path, data)
+		if err != nil {
+			fmt.Println("err in reading document:", err)
+			return nil
+		}
+		chunks := chunkSections(sections, cfg.Docs.ChunkSize)
+		for i := range chunks {
+			chunks[i].Vector, err = embed(c, s.Model, chunks[i].Text)
+			if err != nil {
+				return err
+			}
+		}
+		s.Documents[path] = &Document{
+			Path:    path,
+			Root:    root,
+			Type:    strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."),
+			Tags:    tags,
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+			Hash:    hex.EncodeToString(hash[:]),
+			Chunks:  chunks,
+		}
+		if ok {
+			stats.Updated++
+		} else {
+			stats.Added++
+		}
+		return nil
+	})
+	if err == nil {
+		for path := range s.Documents {
+			if inDir(path, root) && !found[path] {
+				delete(s.Documents, path)
+				stats.Removed++
+			}
+		}
+	}
+	if saveErr := s.Save(); err == nil {
+		err = saveErr
+	}
+	return stats, err
+}
+
+// is the path in the directory
+func inDir(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// does the document match the filter
+func (f Filter) Match(doc *Document) bool {
+	if f.Type != "" && !strings.EqualFold(strings.TrimPrefix(f.Type, "."), doc.Type) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !containsFold(doc.Tags, tag) {
+			return false
+		}
+	}
+	if f.Path != "" {
+		rel, _ := filepath.Rel(doc.Root, doc.Path)
+		path := filepath.Clean(f.Path)
+		matched := false
+		for _, p := range []string{doc.Path, rel} {
+			if ok, _ := filepath.Match(path, p); ok || p == path || inDir(p, path) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// find the n chunks most similar to the vector in the documents that match
+// the filter, most similar first
+func (s *VectorStore) Search(vector []float64, n int, filter Filter) []Match {
+	matches := []Match{}
+	for _, doc := range s.Documents {
+		if !filter.Match(doc) {
+			continue
+		}
+		for _, chunk := range doc.Chunks {
+			matches = append(matches, Match{Document: doc, Chunk: chunk, Score: cosine(vector, chunk.Vector)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		if matches[i].Document.Path != matches[j].Document.Path {
+			return matches[i].Document.Path < matches[j].Document.Path
+		}
+		return matches[i].Chunk.StartLine < matches[j].Chunk.StartLine
+	})
+	if len(matches) > n {
+		matches = matches[:n]
+	}
+	return matches
+}
+
+// cosine similarity of two vectors
+func cosine(a []float64, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// where the match is, as the file relative to the directory indexed and the
+// lines or section
+func (m Match) Location() string {
+	file, err := filepath.Rel(m.Document.Root, m.Document.Path)
+	if err != nil {
+		file = m.Document.Path
+	}
+	// lines are only cited for documents without sections
+	if m.Chunk.Section != "" {
+		return fmt.Sprintf("%s, %s", file, m.Chunk.Section)
+	}
+	if m.Chunk.StartLine == m.Chunk.EndLine {
+		return fmt.Sprintf("%s:%d", file, m.Chunk.StartLine)
+	}
+	return fmt.Sprintf("%s:%d-%d", file, m.Chunk.StartLine, m.Chunk.EndLine)
+}
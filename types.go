@@ -5,15 +5,18 @@ import (
 )
 
 type SearchResult struct {
-	Title string
-	Info  string
-	Url   string
+	Title string `json:"title"`
+	Info  string `json:"info"`
+	Url   string `json:"url"`
 }
 
 type CommandResponse struct {
 	Inputs  []string `json:"inputs"`
 	Command string   `json:"command"`
 	Outputs []string `json:"outputs"`
+	// what the command does, and how risky it is to run, low, medium or high
+	Explanation string `json:"explanation"`
+	Risk        string `json:"risk"`
 }
 
 type CompletionRequest struct {
@@ -31,6 +34,7 @@ type CompletionResponse struct {
 	Model              string        `json:"model"`
 	CreatedAt          time.Time     `json:"created_at"`
 	Response           string        `json:"response"`
+	Message            *Message      `json:"message,omitempty"`
 	Done               bool          `json:"done"`
 	Context            []int         `json:"context,omitempty"`
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
@@ -53,6 +57,28 @@ type ImageQuery struct {
 	Images []string `json:"images"`
 }
 
+type ShowResponse struct {
+	Modelfile  string `json:"modelfile"`
+	Parameters string `json:"parameters"`
+	Template   string `json:"template"`
+	Details    struct {
+		Format            string   `json:"format"`
+		Family            string   `json:"family"`
+		Families          []string `json:"families"`
+		ParameterSize     string   `json:"parameter_size"`
+		QuantizationLevel string   `json:"quantization_level"`
+	} `json:"details"`
+}
+
+type EmbeddingRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+}
+
+type EmbeddingResponse struct {
+	Embedding []float64 `json:"embedding"`
+}
+
 type Models struct {
 	Models []struct {
 		Name       string `json:"name"`
@@ -71,6 +97,28 @@ type OpenAIResponse struct {
 	Choices []Choice `json:"choices"`
 }
 
+// for OpenAI requests with images
+type VisionRequest struct {
+	Model     string          `json:"model"`
+	Messages  []VisionMessage `json:"messages"`
+	MaxTokens int             `json:"max_tokens"`
+}
+
+type VisionMessage struct {
+	Role    string        `json:"role"`
+	Content []ContentPart `json:"content"`
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
@@ -90,5 +138,52 @@ type Message struct {
 type Choice struct {
 	Message       Message       `json:"message"`
 	FinishDetails FinishDetails `json:"finish_details"`
+	FinishReason  string        `json:"finish_reason,omitempty"`
 	Index         int           `json:"index"`
 }
+
+// for the OpenAI compatible gateway
+type ChatCompletionRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+}
+
+type ChatCompletionChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int           `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+}
+
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type Delta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type ModelList struct {
+	Object string        `json:"object"`
+	Data   []ModelObject `json:"data"`
+}
+
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int    `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type ChatRequest struct {
+	Model    string         `json:"model"`
+	Messages []Message      `json:"messages"`
+	Format   string         `json:"format,omitempty"`
+	Options  map[string]any `json:"options,omitempty"`
+	Stream   bool           `json:"stream"`
+}
@@ -1,19 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"os/exec"
 	"strings"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/hako/durafmt"
 	"github.com/tmc/langchaingo/llms"
@@ -21,108 +17,312 @@ import (
 	"github.com/tmc/langchaingo/schema"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"mvdan.cc/sh/v3/interp"
 )
 
-// run shell commands
-func run(tool string, args []string) ([]byte, error) {
-	fmt.Println(yellow("executing>"), green(tool), green(strings.Join(args, " ")))
-	cmd := exec.Command(tool, args...)
-	return cmd.CombinedOutput()
+// run a command line in the shell, checking it against the policy of the
+// shell profile first. Command lines the policy wants confirmed are only run
+// if confirm returns true. The output and error output are written as the
+// command runs, and everything it wrote is returned. The exit status is
+// reported to stderr when the command is done.
+func run(c context.Context, line string, confirm func(string) bool, stdout io.Writer, stderr io.Writer) ([]byte, error) {
+	policy, err := commandPolicy()
+	if err != nil {
+		return nil, err
+	}
+	ask, err := policy.Check(line)
+	if err != nil {
+		return nil, err
+	}
+	if policy.DryRun {
+		fmt.Fprintln(stderr, yellow("dry run>"), green(line))
+		return nil, nil
+	}
+	if ask && !confirm(line) {
+		return nil, fmt.Errorf("command not run")
+	}
+	if sh == nil {
+		sh, err = newShell()
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := parseCommand(line)
+	if err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if cfg.Timeouts.Command > 0 {
+		ctx, cancel = context.WithTimeout(c, cfg.Timeouts.Command)
+	} else {
+		ctx, cancel = context.WithCancel(c)
+	}
+	defer cancel()
+	// programs that need to be confirmed once the command line is expanded
+	// are confirmed as they are run, unless they are in the confirmed line
+	typed := strings.Join(strings.Fields(line), " ")
+	ctx = withConfirm(ctx, func(command string) bool {
+		return (ask && strings.Contains(typed, command)) || confirm(command)
+	})
+	fmt.Fprintln(stderr, yellow("executing>"), green(line))
+	t0 := time.Now()
+	out, err := sh.Run(ctx, file, stdout, stderr)
+	status, ok := interp.IsExitStatus(err)
+	sh.Last = &ShellOutput{Command: line, Output: string(out), Status: int(status)}
+	if c.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return out, fmt.Errorf("command timed out after %s", cfg.Timeouts.Command)
+	}
+	if err != nil && !ok {
+		return out, err
+	}
+	elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
+	if status == 0 {
+		fmt.Fprintln(stderr, cyan(fmt.Sprintf("(exit status 0, %s)", elapsed)))
+	} else {
+		fmt.Fprintln(stderr, red(fmt.Sprintf("(exit status %d, %s)", status, elapsed)))
+	}
+	return out, err
 }
 
-// search the Internet and retu
-func search(model string, query string) error {
-	data, result, err := ddg(query)
+// search the Internet and answer the query using the search results
+func search(c context.Context, out Sink, model string, query string, opts SearchOptions) (string, error) {
+	err := opts.Validate()
+	if err != nil {
+		return "", err
+	}
+	queries := []string{query}
+	if opts.Rewrite {
+		queries = rewriteQuery(c, model, query)
+	}
+	result, err := searchAll(c, queries, opts)
 	if err != nil {
 		log.Println("Cannot process query:", err)
-		return err
-	}
-	prompt := `The following search results has come back from a search engine given the query 
-that came from a user. Respond to the original query using the search results. Do not add any 
-additional information. Assume the person you are explaining to doesn't know anything about 
-the answer and provide a detailed response based on the query results only.	End the response 
-with a list of URLs returned.`
-	ctx := `{
-	"query" : "` + query + `",
-	"search_result" : "` + data + `",
-	"urls" : "` + fmt.Sprint(result) + `"
-}`
-	return predict(model, prompt, ctx, "")
-}
-
-func ask(model string, query string) error {
-	prompt := `Give immediate, precise and clear answers to questions asked. If you do not know 
-the answer, say "I don't know the answer to this.".
-`
-	return predict(model, prompt, query, "")
-}
-
-// prediction multiplexer
-func predict(model string, prompt string, ctx string, format string) error {
-	switch model {
-	case "gpt-3.5-turbo":
-		return gpt(model, prompt, ctx, format)
-	case "gpt-4":
-		return gpt(model, prompt, ctx, format)
-	case "gpt-4-turbo":
-		return gpt("gpt-4-1106-preview", prompt, ctx, format)
-	case "gpt-4-vision":
-		return gpt("gpt-4-vision-preview", prompt, ctx, format)
-	case "gemini-pro":
-		return gemini(model, prompt, ctx, format)
-	case "gemini-pro-vision":
-		return gemini(model, prompt, ctx, format)
-	default:
-		return ollama(model, prompt, ctx, format)
+		return "", err
+	}
+	pages := fetchPages(c, result, cfg.Search.Pages, opts.Fresh)
+	data := formatPages(pages, excerptLength(c, model, min(len(pages), cfg.Search.Pages)))
+	ctx, err := json.MarshalIndent(struct {
+		Query        string `json:"query"`
+		SearchResult string `json:"search_result"`
+	}{query, data}, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	// add the sources cited to the end of the answer
+	sink := &citeSink{Sink: out}
+	answer, err := predict(c, sink, model, cfg.Prompts.Search, string(ctx), "")
+	if err != nil {
+		return answer, err
+	}
+	footer := checkCitations(answer, result).Footer()
+	err = out.Token(footer)
+	out.Done(sink.stats)
+	return answer + footer, err
+}
+
+// ask the model, keeping the earlier turns of the conversation in the session,
+// the text of the document files attached and the output of the shell
+// command, if any, are given with the query
+func ask(c context.Context, out Sink, s *Session, model string, query string, files []string, output *ShellOutput) (string, error) {
+	c, cancel := withGenerateTimeout(c)
+	defer cancel()
+	conv := s.Conversation()
+	parts := []string{}
+	n := len(files)
+	if output != nil {
+		n++
+	}
+	if len(files) > 0 {
+		documents, err := formatFiles(files, excerptLength(c, model, n)*len(files))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, strings.TrimSpace(cfg.Prompts.Files+"\n\n"+documents))
+	}
+	if output != nil {
+		parts = append(parts, strings.TrimSpace(cfg.Prompts.Output+"\n\n"+output.Format(excerptLength(c, model, n))))
+	}
+	content := query
+	if len(parts) > 0 {
+		content = strings.Join(parts, "\n\n") + "\n\nQuestion: " + query
+	}
+	conv.Add("user", content)
+	command := ""
+	if output != nil {
+		command = output.Command
+	}
+	t0 := time.Now()
+	answer, err := getProvider(c, model).Chat(c, out, model, cfg.Prompts.Ask, conv)
+	if err != nil {
+		return answer, err
+	}
+	return answer, s.AddTurn(Turn{
+		Model:    model,
+		Prompt:   query,
+		Answer:   answer,
+		Files:    files,
+		Command:  command,
+		Time:     t0,
+		Duration: time.Since(t0),
+	})
+}
+
+// prediction multiplexer, routes the model to the provider that serves it
+func predict(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
+	c, cancel := withGenerateTimeout(c)
+	defer cancel()
+	// only ask for JSON from models that can respond in JSON
+	if format == "json" && !catalog.Lookup(c, model).JSON {
+		format = ""
 	}
+	return getProvider(c, model).Predict(c, out, model, prompt, ctx, format)
+}
+
+// limit the time to generate an answer if it is configured
+func withGenerateTimeout(c context.Context) (context.Context, context.CancelFunc) {
+	if cfg.Timeouts.Generate > 0 {
+		return context.WithTimeout(c, cfg.Timeouts.Generate)
+	}
+	return context.WithCancel(c)
 }
 
 // Call OpenAI APIs to predict
 // uses langchaingo
-func gpt(model string, prompt string, ctx string, format string) error {
-	t0 := time.Now()
-	llm, err := openai.NewChat(openai.WithModel(model))
+func gpt(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
+	conv := &Conversation{}
+	conv.Add("user", ctx)
+	return gptChat(c, out, model, prompt, conv)
+}
+
+// Call OpenAI APIs to chat, sending the conversation history
+func gptChat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error) {
+	s := newStream(out, model)
+	llm, err := newOpenAIChat(model)
 	if err != nil {
-		return err
+		return "", err
 	}
-	c := context.Background()
-	_, err = llm.Call(c, []schema.ChatMessage{
-		schema.SystemChatMessage{Content: prompt},
-		schema.HumanChatMessage{Content: ctx},
-	}, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-		fmt.Print(string(chunk))
-		return nil
-	}), llms.WithMinLength(1024),
-	)
+	messages := []schema.ChatMessage{schema.SystemChatMessage{Content: prompt}}
+	for _, m := range conv.Messages {
+		if m.Role == "assistant" {
+			messages = append(messages, schema.AIChatMessage{Content: m.Content})
+		} else {
+			messages = append(messages, schema.HumanChatMessage{Content: m.Content})
+		}
+	}
+	options := []llms.CallOption{
+		llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			return s.Token(string(chunk))
+		}),
+		llms.WithMinLength(1024),
+	}
+	info := catalog.Lookup(c, model)
+	if v, ok := info.Float("temperature"); ok {
+		options = append(options, llms.WithTemperature(v))
+	}
+	if v, ok := info.Float("top_p"); ok {
+		options = append(options, llms.WithTopP(v))
+	}
+	_, err = llm.Call(c, messages, options...)
 	if err != nil {
-		return err
+		return "", err
 	}
-	elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
-	fmt.Printf(cyan("\n\n(%s)"), elapsed)
-	fmt.Println()
+	return s.Done(Stats{}), nil
+}
 
-	return nil
+// create an OpenAI chat client with the configured API key and base URL
+func newOpenAIChat(model string) (*openai.Chat, error) {
+	opts := []openai.Option{openai.WithModel(model)}
+	if cfg.OpenAI.APIKey != "" {
+		opts = append(opts, openai.WithToken(cfg.OpenAI.APIKey))
+	}
+	if cfg.OpenAI.BaseURL != "" {
+		opts = append(opts, openai.WithBaseURL(cfg.OpenAI.BaseURL))
+	}
+	return openai.NewChat(opts...)
+}
+
+// base URL of the OpenAI API
+func openaiBaseURL() string {
+	if cfg.OpenAI.BaseURL != "" {
+		return strings.TrimSuffix(cfg.OpenAI.BaseURL, "/")
+	}
+	return "https://api.openai.com/v1"
 }
 
 // call Gemini API to predict
-func gemini(model string, prompt string, ctx string, format string) error {
-	t0 := time.Now()
-	client, err := genai.NewClient(context.Background(), option.WithAPIKey(os.Getenv("GOOGLEAI_API_KEY")))
+func gemini(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
+	s := newStream(out, model)
+	client, err := genai.NewClient(c, option.WithAPIKey(cfg.Gemini.APIKey))
+	if err != nil {
+		fmt.Println("cannot create Gemini client:", err)
+		return "", err
+	}
+	defer client.Close()
+
+	gemini := geminiModel(c, client, model)
+	iter := gemini.GenerateContentStream(c, genai.Text(prompt), genai.Text(ctx))
+	err = geminiStream(iter, s)
+	if err != nil {
+		return "", err
+	}
+	return s.Done(Stats{}), nil
+}
+
+// call Gemini API to chat, the earlier turns are sent as the chat session history
+func geminiChat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error) {
+	s := newStream(out, model)
+	client, err := genai.NewClient(c, option.WithAPIKey(cfg.Gemini.APIKey))
 	if err != nil {
 		fmt.Println("cannot create Gemini client:", err)
-		return err
+		return "", err
 	}
 	defer client.Close()
 
+	if len(conv.Messages) == 0 {
+		return "", fmt.Errorf("nothing to send to %s", model)
+	}
+	gemini := geminiModel(c, client, model)
+	cs := gemini.StartChat()
+	for _, m := range conv.Messages[:len(conv.Messages)-1] {
+		role := "user"
+		if m.Role == "assistant" {
+			role = "model"
+		}
+		cs.History = append(cs.History, &genai.Content{Role: role, Parts: []genai.Part{genai.Text(m.Content)}})
+	}
+	last := conv.Messages[len(conv.Messages)-1]
+	parts := []genai.Part{genai.Text(last.Content)}
+	if prompt != "" {
+		parts = append([]genai.Part{genai.Text(prompt)}, parts...)
+	}
+	iter := cs.SendMessageStream(c, parts...)
+	err = geminiStream(iter, s)
+	if err != nil {
+		return "", err
+	}
+	return s.Done(Stats{}), nil
+}
+
+// get the Gemini model with the default options for the model
+func geminiModel(c context.Context, client *genai.Client, model string) *genai.GenerativeModel {
 	gemini := client.GenerativeModel(model)
-	iter := gemini.GenerateContentStream(context.Background(), genai.Text(prompt), genai.Text(ctx))
+	info := catalog.Lookup(c, model)
+	if v, ok := info.Float("temperature"); ok {
+		gemini.SetTemperature(float32(v))
+	}
+	if v, ok := info.Float("top_p"); ok {
+		gemini.SetTopP(float32(v))
+	}
+	return gemini
+}
+
+// send the parts of the Gemini responses to the stream
+func geminiStream(iter *genai.GenerateContentResponseIterator, s *stream) error {
 	for {
 		resp, err := iter.Next()
 		if err == iterator.Done {
-			elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
-			fmt.Printf(cyan("\n\n(%s)"), elapsed)
-			fmt.Println()
-			break
+			return nil
 		}
 		if err != nil {
 			fmt.Println("cannot generate content:", err)
@@ -132,22 +332,25 @@ func gemini(model string, prompt string, ctx string, format string) error {
 			if cand.Content != nil {
 				for _, part := range cand.Content.Parts {
 					if part != nil {
-						fmt.Print(part)
+						err = s.Token(fmt.Sprint(part))
+						if err != nil {
+							return err
+						}
 					}
 				}
 			}
 		}
 	}
-	return nil
 }
 
 // predict by calling Ollama with a given model
-func ollama(model string, prompt string, ctx string, format string) error {
+func ollama(c context.Context, out Sink, model string, prompt string, ctx string, format string) (string, error) {
 	req := &CompletionRequest{
-		Model:  model,
-		Prompt: prompt,
-		System: ctx,
-		Stream: true,
+		Model:   model,
+		Prompt:  prompt,
+		System:  ctx,
+		Options: catalog.Lookup(c, model).Options,
+		Stream:  true,
 	}
 	if format == "json" {
 		req.Format = "json"
@@ -156,76 +359,67 @@ func ollama(model string, prompt string, ctx string, format string) error {
 	reqJson, err := json.Marshal(req)
 	if err != nil {
 		fmt.Println("err in marshaling:", err)
-		return err
+		return "", err
 	}
 
-	r := bytes.NewReader(reqJson)
-	httpResp, err := http.Post("http://localhost:11435/api/generate", "application/json", r)
+	httpResp, err := postOllama(c, "/api/generate", reqJson)
 	if err != nil {
 		fmt.Println("err in calling ollama:", err)
-		return err
-	}
-	decoder := json.NewDecoder(httpResp.Body)
-	t0 := time.Now()
-	for {
-		resp := &CompletionResponse{}
-		decoder.Decode(&resp)
-		fmt.Print(resp.Response)
-		if resp.Done {
-			elapsed := durafmt.Parse(time.Since(t0)).LimitFirstN(2)
-			fmt.Printf(cyan("\n\n(%s)"), elapsed)
-			fmt.Println()
-			break
-		}
+		return "", err
 	}
-	return err
+	defer httpResp.Body.Close()
+	return ollamaStream(httpResp.Body, newStream(out, model))
 }
 
-// use DuckDuckGo to search the Internet and return the top 5 results
-func ddg(query string) (string, []SearchResult, error) {
-	queryURL := fmt.Sprintf("https://html.duckduckgo.com/html/?q=%s", url.QueryEscape(query))
-	userAgent := "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15"
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", queryURL, nil)
-	if err != nil {
-		return "", []SearchResult{}, err
-	}
-	request.Header.Set("User-Agent", userAgent)
-	response, err := client.Do(request)
-	if err != nil {
-		return "", []SearchResult{}, err
+// chat by calling Ollama's chat endpoint with the conversation history
+func ollamaChat(c context.Context, out Sink, model string, prompt string, conv *Conversation) (string, error) {
+	req := &ChatRequest{
+		Model:    model,
+		Messages: append([]Message{{Role: "system", Content: prompt}}, conv.Messages...),
+		Options:  catalog.Lookup(c, model).Options,
+		Stream:   true,
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		return "", []SearchResult{}, fmt.Errorf("status is %d", response.StatusCode)
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		fmt.Println("err in marshaling:", err)
+		return "", err
 	}
 
-	doc, err := goquery.NewDocumentFromReader(response.Body)
+	httpResp, err := postOllama(c, "/api/chat", reqJson)
 	if err != nil {
-		return "", []SearchResult{}, err
+		fmt.Println("err in calling ollama:", err)
+		return "", err
 	}
+	defer httpResp.Body.Close()
+	return ollamaStream(httpResp.Body, newStream(out, model))
+}
 
-	results := []SearchResult{}
-	sel := doc.Find(".web-result")
-	// text := ""
-	for i := range sel.Nodes {
-		if len(results) > 5 {
-			break
+// send the streamed responses from the generate or chat endpoints of
+// Ollama to the stream, returns the whole answer
+func ollamaStream(body io.Reader, s *stream) (string, error) {
+	decoder := json.NewDecoder(body)
+	for {
+		resp := &CompletionResponse{}
+		err := decoder.Decode(&resp)
+		if err != nil {
+			fmt.Println("err in reading from ollama:", err)
+			return "", err
+		}
+		// chat responses have the chunk in the message
+		chunk := resp.Response
+		if resp.Message != nil {
+			chunk = resp.Message.Content
+		}
+		err = s.Token(chunk)
+		if err != nil {
+			return "", err
+		}
+		if resp.Done {
+			return s.Done(Stats{
+				PromptTokens:     resp.PromptEvalCount,
+				CompletionTokens: resp.EvalCount,
+			}), nil
 		}
-
-		node := sel.Eq(i)
-		titleNode := node.Find(".result__a")
-		info := node.Find(".result__snippet").Text()
-		title := titleNode.Text()
-		url, _ := node.Find(".result__snippet").Attr("href")
-		results = append(results, SearchResult{title, info, url})
-	}
-	formattedResults := ""
-
-	for _, result := range results {
-		formattedResults += fmt.Sprintf("Title: %s\n"+
-			"Description: %s\n\n", result.Title, result.Info)
 	}
-	return formattedResults, results, nil
 }
@@ -1,10 +1,24 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"mvdan.cc/sh/v3/interp"
 )
 
 func TestParseImage(t *testing.T) {
@@ -31,10 +45,1384 @@ func TestCallGPT4Vision(t *testing.T) {
 	file2, _ := os.ReadFile(img2)
 
 	b64 := []string{base64.StdEncoding.EncodeToString(file1), base64.StdEncoding.EncodeToString(file2)}
-	results, err := callGPT4Vision("what are these images about?", b64)
+	results, err := callGPT4Vision(context.Background(), "gpt-4-vision-preview", "what are these images about?", b64)
 	if err != nil {
 		t.Error(err)
 	}
 	fmt.Println(results)
 
 }
+
+func TestGPTImage(t *testing.T) {
+	var req VisionRequest
+	status, choices := http.StatusOK, []Choice{{Message: Message{Role: "assistant", Content: "Waldo is on the beach."}}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&req)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(OpenAIResponse{Choices: choices})
+	}))
+	defer ts.Close()
+	old := cfg.OpenAI.BaseURL
+	cfg.OpenAI.BaseURL = ts.URL
+	defer func() { cfg.OpenAI.BaseURL = old }()
+
+	img := filepath.Join(t.TempDir(), "beach.jpg")
+	os.WriteFile(img, []byte("waldo"), 0o644)
+	out := &strings.Builder{}
+	answer, err := gptImage(context.Background(), &WriterSink{W: out}, "gpt-4o", "where is waldo?", `"beach" \ sea`, []string{img})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "Waldo is on the beach." {
+		t.Errorf("unexpected answer %s", answer)
+	}
+	if req.Model != "gpt-4o" || len(req.Messages) != 1 || len(req.Messages[0].Content) != 2 ||
+		req.Messages[0].Content[0].Text != `where is waldo? ## "beach" \ sea` ||
+		req.Messages[0].Content[1].ImageURL.URL != "data:image/jpeg;base64,"+base64.StdEncoding.EncodeToString([]byte("waldo")) {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	choices = nil
+	if _, err = gptImage(context.Background(), &FuncSink{}, "gpt-4o", "where is waldo?", "", []string{img}); err == nil {
+		t.Errorf("expected an error when there are no choices")
+	}
+	status = http.StatusUnauthorized
+	if _, err = gptImage(context.Background(), &FuncSink{}, "gpt-4o", "where is waldo?", "", []string{img}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected an error for the status, got %v", err)
+	}
+}
+
+func TestGetProvider(t *testing.T) {
+	yes, no := true, false
+	cfg.Models = []ModelConfig{
+		{Name: "gpt-4o", Provider: "openai", Vision: &yes, ContextWindow: 128000},
+		{Name: "gpt-4-vision", Vision: &no},
+	}
+	defer func() { cfg.Models = nil }()
+	catalog = &Catalog{models: map[string]ModelInfo{}}
+	shown := 0
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/show" {
+			shown++
+		}
+		http.NotFound(w, r)
+	})
+	tests := map[string]string{
+		"gpt-4-turbo":       "openai",
+		"gemini-pro-vision": "gemini",
+		"llama2:13b":        "ollama",
+		"gpt-4o":            "openai",
+	}
+	for model, name := range tests {
+		if p := getProvider(context.Background(), model); p.Name() != name {
+			t.Errorf("provider for %s is %s, expected %s", model, p.Name(), name)
+		}
+	}
+	if info := catalog.Lookup(context.Background(), "gpt-4o"); !info.Vision || info.ContextWindow != 128000 {
+		t.Errorf("unexpected model info for gpt-4o %+v", info)
+	}
+	if info := catalog.Lookup(context.Background(), "gemini-pro"); info.Vision {
+		t.Errorf("gemini-pro should not have vision")
+	}
+	if info := catalog.Lookup(context.Background(), "gpt-4-vision"); info.Vision || info.ContextWindow != 128000 {
+		t.Errorf("vision should be turned off for gpt-4-vision %+v", info)
+	}
+	// unknown models are only looked up in Ollama once
+	catalog.Lookup(context.Background(), "llama2:13b")
+	if shown != 1 {
+		t.Errorf("ollama was asked about llama2:13b %d times", shown)
+	}
+}
+
+func TestSessionSaveLoad(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	s := newSession()
+	err := s.AddTurn(Turn{Model: "llama2:13b", Prompt: "Why is the sky blue?", Answer: "Rayleigh scattering.", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadSession(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Name != "Why is the sky blue?" || len(loaded.Turns) != 1 || loaded.Model != "llama2:13b" {
+		t.Errorf("loaded session does not match saved session: %+v", loaded)
+	}
+	conv := loaded.Conversation()
+	if len(conv.Messages) != 2 || conv.Messages[1].Role != "assistant" {
+		t.Errorf("unexpected conversation: %+v", conv.Messages)
+	}
+	err = deleteSession(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := listSessions()
+	if len(sessions) != 0 {
+		t.Errorf("expected no sessions, got %d", len(sessions))
+	}
+	// IDs that are not session IDs are not used as file names
+	os.WriteFile(filepath.Join(os.Getenv("HOME"), "secret.json"), []byte(`{"id": "20231229-221504"}`), 0o644)
+	for _, id := range []string{"../../secret", "../secret", "20231229-221504/../../secret", ""} {
+		if _, err := loadSession(id); err == nil {
+			t.Errorf("expected session %q not to be loaded", id)
+		}
+		if err := deleteSession(id); err == nil {
+			t.Errorf("expected session %q not to be deleted", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(os.Getenv("HOME"), "secret.json")); err != nil {
+		t.Errorf("expected the file not to be deleted, got %v", err)
+	}
+
+	// sessions created in the same second have different IDs
+	if a, b := newSession(), newSession(); a.ID == b.ID {
+		t.Errorf("expected different session IDs, got %s twice", a.ID)
+	}
+}
+
+func TestRunOnceUsage(t *testing.T) {
+	tests := map[string][]string{
+		"unknown command":    {"bogus"},
+		"ask without query":  {"ask"},
+		"image without file": {"image", "what is this?"},
+	}
+	for name, args := range tests {
+		if code := runOnce(args); code != exitUsage {
+			t.Errorf("%s: exit code is %d, expected %d", name, code, exitUsage)
+		}
+	}
+}
+
+func TestConversation(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var messages []Message
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/chat":
+			req := ChatRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			messages = req.Messages
+			answer := fmt.Sprintf("answer %d", len(req.Messages)/2)
+			json.NewEncoder(w).Encode(CompletionResponse{Message: &Message{Role: "assistant", Content: answer}})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+
+	// the earlier turns in the session are sent with each question
+	s := newSession()
+	for _, query := range []string{"Where is Waldo?", "What is he wearing?"} {
+		_, err := ask(context.Background(), &FuncSink{}, s, "waldo-chat", query, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	roles := []string{}
+	for _, m := range messages {
+		roles = append(roles, m.Role)
+	}
+	if strings.Join(roles, " ") != "system user assistant user" || messages[1].Content != "Where is Waldo?" ||
+		messages[2].Content != "answer 1" || messages[3].Content != "What is he wearing?" {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+
+	// a new session starts the conversation again
+	s = newSession()
+	_, err := ask(context.Background(), &FuncSink{}, s, "waldo-chat", "Who is Odlaw?", nil, nil)
+	if err != nil || len(messages) != 2 || messages[1].Content != "Who is Odlaw?" {
+		t.Errorf("expected only the new question, got %+v, %v", messages, err)
+	}
+}
+
+func TestServerSwitchModel(t *testing.T) {
+	s := &Server{model: "llama2:13b"}
+	router := gin.New()
+	router.POST("/api/model", s.switchModel)
+	router.POST("/api/ask", s.ask)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/model", strings.NewReader(`{"model": "mistral:latest"}`)))
+	if w.Code != http.StatusOK || s.model != "mistral:latest" {
+		t.Errorf("model not switched, status %d, model %s", w.Code, s.model)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/ask", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status is %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/chat":
+			json.NewEncoder(w).Encode(CompletionResponse{Message: &Message{Role: "assistant", Content: "At the beach."}})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+	s := &Server{model: "waldo-server"}
+	router := gin.New()
+	router.POST("/api/ask", s.ask)
+	ask := func(session string) (int, ServerResponse) {
+		body, _ := json.Marshal(ServerRequest{Query: "Where is Waldo?", Session: session})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/ask", bytes.NewReader(body)))
+		resp := ServerResponse{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// requests without a session are not saved
+	code, resp := ask("")
+	sessions, _ := listSessions()
+	if code != http.StatusOK || resp.Session != "" || len(sessions) != 0 {
+		t.Errorf("expected no session, got %d %+v and %d sessions", code, resp, len(sessions))
+	}
+
+	code, resp = ask("new")
+	if code != http.StatusOK || resp.Session == "" {
+		t.Fatalf("expected a new session, got %d %+v", code, resp)
+	}
+	code, _ = ask(resp.Session)
+	loaded, err := loadSession(resp.Session)
+	if code != http.StatusOK || err != nil || len(loaded.Turns) != 2 {
+		t.Errorf("expected the session to be continued, got %d %+v %v", code, loaded, err)
+	}
+
+	code, _ = ask("../../waldo")
+	if code == http.StatusOK {
+		t.Errorf("expected an invalid session to be rejected")
+	}
+
+	// the locks are removed once the requests are done
+	sessionLocks.Lock()
+	n := len(sessionLocks.locks)
+	sessionLocks.Unlock()
+	if n != 0 {
+		t.Errorf("expected no session locks, got %d", n)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/tags":
+			w.Write([]byte(`{"models": [{"name": "waldo-gateway"}]}`))
+		case "/api/chat":
+			req := ChatRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			switch req.Messages[len(req.Messages)-1].Content {
+			case "fail":
+				http.Error(w, "model not found", http.StatusNotFound)
+			case "break":
+				// the connection is closed in the middle of the answer
+				json.NewEncoder(w).Encode(CompletionResponse{Message: &Message{Role: "assistant", Content: "Waldo is "}})
+			default:
+				json.NewEncoder(w).Encode(CompletionResponse{Message: &Message{Role: "assistant", Content: "Waldo is "}})
+				json.NewEncoder(w).Encode(CompletionResponse{Message: &Message{Role: "assistant", Content: "at the beach."}})
+				json.NewEncoder(w).Encode(CompletionResponse{Done: true, PromptEvalCount: 12, EvalCount: 5})
+			}
+		}
+	})
+	s := &Server{model: "waldo-gateway"}
+	router := gin.New()
+	router.POST("/v1/chat/completions", s.chatCompletions)
+	router.GET("/v1/models", s.listModels)
+	chat := func(content string, stream bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ChatCompletionRequest{
+			Messages: []Message{{Role: "system", Content: "You are Waldo."}, {Role: "user", Content: content}},
+			Stream:   stream,
+		})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body)))
+		return w
+	}
+
+	w := chat("where is waldo?", false)
+	resp := OpenAIResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "Waldo is at the beach." ||
+		resp.Model != "waldo-gateway" || resp.Usage.TotalTokens != 17 {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body)
+	}
+
+	w = chat("where is waldo?", true)
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	n := len(events)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" || n < 5 ||
+		!strings.Contains(events[0], `"role":"assistant"`) || !strings.Contains(events[2], "at the beach.") ||
+		!strings.Contains(events[n-2], `"finish_reason":"stop"`) || events[n-1] != "data: [DONE]" {
+		t.Errorf("unexpected stream %d %q", w.Code, events)
+	}
+
+	// errors before anything is streamed get an error status
+	for _, stream := range []bool{false, true} {
+		w = chat("fail", stream)
+		if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `"type":"server_error"`) {
+			t.Errorf("expected an error with stream %v, got %d %s", stream, w.Code, w.Body)
+		}
+	}
+
+	// and errors after that are sent in the stream
+	w = chat("break", true)
+	events = strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if w.Code != http.StatusOK || len(events) != 4 || !strings.Contains(events[1], "Waldo is ") ||
+		!strings.HasPrefix(events[2], `data: {"error":`) || events[3] != "data: [DONE]" {
+		t.Errorf("expected an error in the stream, got %d %q", w.Code, events)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models", nil))
+	list := ModelList{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	found := false
+	for _, m := range list.Data {
+		if m.ID == "waldo-gateway" && m.OwnedBy == "ollama" && m.Object == "model" {
+			found = true
+		}
+	}
+	if w.Code != http.StatusOK || list.Object != "list" || !found {
+		t.Errorf("unexpected models %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOllamaStream(t *testing.T) {
+	body := `{"model":"llama2","message":{"role":"assistant","content":"The sky "},"done":false}
+{"model":"llama2","message":{"role":"assistant","content":"is blue."},"done":false}
+{"model":"llama2","message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":12,"eval_count":5}
+`
+	chunks := []string{}
+	stats := Stats{}
+	out := &FuncSink{
+		OnToken: func(chunk string) error {
+			chunks = append(chunks, chunk)
+			return nil
+		},
+		OnDone: func(s Stats) { stats = s },
+	}
+	answer, err := ollamaStream(strings.NewReader(body), newStream(out, "llama2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "The sky is blue." || len(chunks) != 3 {
+		t.Errorf("unexpected answer %q from chunks %q", answer, chunks)
+	}
+	if stats.Model != "llama2" || stats.PromptTokens != 12 || stats.CompletionTokens != 5 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCancelStream(t *testing.T) {
+	release := make(chan struct{})
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/generate":
+			// send the first chunk and hold the connection open
+			json.NewEncoder(w).Encode(CompletionResponse{Response: "Waldo is "})
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+	})
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &FuncSink{OnToken: func(chunk string) error {
+		// cancel like Ctrl-C once the answer has started
+		time.AfterFunc(100*time.Millisecond, cancel)
+		return nil
+	}}
+	done := make(chan error)
+	go func() {
+		_, err := ollama(ctx, out, "waldo-cancel", "Where is Waldo?", "", "")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error when cancelled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("expected the stream to stop when cancelled")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	c := defaultConfig()
+	file := t.TempDir() + "/waldo.yaml"
+	os.WriteFile(file, []byte("model: mistral:latest\nsearch:\n  results: 8\n"), 0o644)
+	err := c.loadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Model != "mistral:latest" || c.Search.Results != 8 || c.Timeouts.Request != 30*time.Second {
+		t.Errorf("unexpected config %+v", c)
+	}
+	err = c.Set("timeouts.generate", "2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := c.Get("timeouts.generate")
+	if value != "2m0s" {
+		t.Errorf("timeouts.generate is %s, expected 2m0s", value)
+	}
+	if c.Set("search.results", "many") == nil {
+		t.Error("expected error setting search.results to a non number")
+	}
+	if _, err = c.Get("search"); err == nil {
+		t.Error("expected error getting a group of settings")
+	}
+	for host, url := range map[string]string{
+		"":               "http://127.0.0.1:11435",
+		"localhost":      "http://localhost:11435",
+		"0.0.0.0:11500":  "http://127.0.0.1:11500",
+		"::1":            "http://[::1]:11435",
+		"ollama.lan:80":  "http://ollama.lan:80",
+		"[fe80::1]:8080": "http://[fe80::1]:8080",
+	} {
+		c.Ollama.Host = host
+		if got := c.ollamaURL(); got != url {
+			t.Errorf("ollama url for %q is %s, expected %s", host, got, url)
+		}
+	}
+
+	// only the user config file and the settings changed are saved
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("OPENAI_API_KEY", "sk-waldo")
+	path, _ := userConfigPath()
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	os.WriteFile(path, []byte("gemini:\n  api_key: wenda\nsearch:\n  engine: brave\n"), 0o600)
+	c, err = loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("search.results", "5")
+	c.Set("timeouts.generate", "2m")
+	_, err = c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	saved := map[string]any{}
+	yaml.Unmarshal(data, &saved)
+	if fmt.Sprint(saved) != "map[gemini:map[api_key:wenda] search:map[engine:brave results:5] timeouts:map[generate:2m0s]]" {
+		t.Errorf("unexpected saved config %s", data)
+	}
+}
+
+func TestSearchEngines(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "json" {
+			t.Errorf("searxng should be asked for json")
+		}
+		if q := r.URL.Query(); q.Get("q") != "where is waldo site:example.com" || q.Get("time_range") != "week" || q.Get("language") != "en-SG" {
+			t.Errorf("search options not passed to searxng %v", q)
+		}
+		w.Write([]byte(`{"results": [{"title": "Waldo", "url": "https://example.com", "content": "where is waldo"}]}`))
+	}))
+	defer ts.Close()
+	cfg.Search.SearXNG.URL = ts.URL
+	file := t.TempDir() + "/fixture.json"
+	os.WriteFile(file, []byte(`{
+		"*": [{"title": "Waldo", "info": "where is waldo", "url": "https://example.com"}],
+		"waldo beach": [{"title": "Beach", "url": "https://example.com/beach"}, {"title": "Waldo", "url": "https://example.com"}],
+		"waldo shirt": [{"title": "Shirt", "url": "https://example.com/shirt"}]
+	}`), 0o644)
+	cfg.Search.Fixture.File = file
+	defer func() { cfg.Search = defaultConfig().Search }()
+
+	for _, name := range []string{"searxng", "fixture"} {
+		e, err := getEngine(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := e.Search(context.Background(), "where is waldo", SearchOptions{Site: "example.com", Region: "sg", Time: "week"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0] != (SearchResult{"Waldo", "where is waldo", "https://example.com"}) {
+			t.Errorf("unexpected results from %s %+v", name, results)
+		}
+	}
+	if _, err := getEngine("altavista"); err == nil {
+		t.Errorf("expected an error for an unknown engine")
+	}
+	results, err := searchAll(context.Background(), []string{"waldo beach", "waldo shirt", "waldo"}, SearchOptions{Engine: "fixture"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if titles := fmt.Sprint(results); titles != "[{Beach  https://example.com/beach} {Shirt  https://example.com/shirt} {Waldo where is waldo https://example.com}]" {
+		t.Errorf("unexpected merged results %s", titles)
+	}
+	if err := (SearchOptions{Engine: "fixture", Time: "decade"}).Validate(); err == nil {
+		t.Errorf("expected an error for an unknown time range")
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var ctx string
+	ts := fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/generate":
+			req := CompletionRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			ctx = req.System
+			json.NewEncoder(w).Encode(CompletionResponse{Response: "Waldo is at the beach [1]."})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		default:
+			w.Write([]byte(`<html><body><p>Waldo said "I'm at the beach" \ and left.</p></body></html>`))
+		}
+	})
+	file := t.TempDir() + "/fixture.json"
+	os.WriteFile(file, []byte(`{"*": [{"title": "Beach", "info": "waldo at the beach", "url": "`+ts.URL+`/beach"}]}`), 0o644)
+	cfg.Search.Fixture.File = file
+	defer func() { cfg.Search = defaultConfig().Search }()
+
+	// the query and pages are given to the model as JSON, whatever is in them
+	_, err := search(context.Background(), &FuncSink{}, "waldo-search", `where is "waldo"?`, SearchOptions{Engine: "fixture"})
+	given := map[string]string{}
+	if err == nil {
+		err = json.Unmarshal([]byte(ctx), &given)
+	}
+	if err != nil || given["query"] != `where is "waldo"?` || !strings.Contains(given["search_result"], `Waldo said "I'm at the beach" \ and left.`) {
+		t.Errorf("unexpected context %s, %v", ctx, err)
+	}
+}
+
+func TestRewriteQuery(t *testing.T) {
+	var ctx string
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/generate":
+			req := CompletionRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			ctx = req.System
+			json.NewEncoder(w).Encode(CompletionResponse{Response: `{"queries": ["waldo beach", " ", "waldo shirt", "odlaw", "wenda"]}`})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+	question := `where is "waldo"?`
+	queries := rewriteQuery(context.Background(), "waldo-rewrite", question)
+	given := map[string]string{}
+	err := json.Unmarshal([]byte(ctx), &given)
+	if err != nil || given["question"] != question {
+		t.Errorf("unexpected context %s, %v", ctx, err)
+	}
+	if fmt.Sprint(queries) != "[waldo beach waldo shirt odlaw]" {
+		t.Errorf("unexpected queries %q", queries)
+	}
+}
+
+func TestFetchPages(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body>
+<nav><a href="/">Home</a> <a href="/about">About</a></nav>
+<div class="sidebar"><p>Subscribe</p></div>
+<div class="content">
+  <h1>Where is Waldo?</h1>
+  <p>Waldo is hiding in a crowd of people at the beach.</p>
+  <p>He wears a red and white striped shirt.</p>
+</div>
+<footer><p>Copyright 2023</p></footer>
+<script>track()</script>
+</body></html>`))
+	}))
+	defer ts.Close()
+
+	pages := fetchPages(context.Background(), []SearchResult{{"Waldo", "where is waldo", ts.URL}, {"Other", "not fetched", ts.URL}}, 1, false)
+	expected := "Where is Waldo?\nWaldo is hiding in a crowd of people at the beach.\nHe wears a red and white striped shirt."
+	if pages[0].Text != expected {
+		t.Errorf("page text is %q, expected %q", pages[0].Text, expected)
+	}
+	if pages[1].Text != "" {
+		t.Errorf("only the top page should be fetched")
+	}
+	if s := truncate(expected, 20); s != "Where is Waldo?..." {
+		t.Errorf("truncated text is %q", s)
+	}
+
+	href := "//duckduckgo.com/l/?uddg=https%3A%2F%2Fexample.com%2Fwaldo%3Fq%3D1&rut=abc"
+	if u := ddgURL(href); u != "https://example.com/waldo?q=1" {
+		t.Errorf("url is %s, expected https://example.com/waldo?q=1", u)
+	}
+}
+
+func TestCheckCitations(t *testing.T) {
+	sources := []SearchResult{
+		{"Where is Waldo", "", "https://example.com/waldo"},
+		{"Striped shirts", "", "https://example.com/shirts"},
+	}
+	answer := `Waldo is hiding at the beach [1]. He wears a striped shirt. [1, 2]
+Nobody has ever found him there.
+He also has a cane [3].`
+	c := checkCitations(answer, sources)
+	if fmt.Sprint(c.Cited) != "[1 2]" || fmt.Sprint(c.Invalid) != "[3]" {
+		t.Errorf("cited %v and invalid %v, expected [1 2] and [3]", c.Cited, c.Invalid)
+	}
+	if len(c.Uncited) != 1 || c.Uncited[0] != "Nobody has ever found him there." {
+		t.Errorf("unexpected uncited sentences %q", c.Uncited)
+	}
+	footer := c.Footer()
+	if !strings.Contains(footer, "[2] Striped shirts\n    https://example.com/shirts") {
+		t.Errorf("sources missing from footer %q", footer)
+	}
+
+	// numbers and abbreviations do not end a sentence
+	answer = `The population is 5.6 million people in Singapore [1]. Waldo wears stripes, e.g. a red and white shirt [2].
+He was seen in the U.S. and Canada [1]! Where is he now? Nobody knows where he is.`
+	c = checkCitations(answer, sources)
+	if len(c.Uncited) != 2 || c.Uncited[0] != "Where is he now?" || c.Uncited[1] != "Nobody knows where he is." {
+		t.Errorf("unexpected uncited sentences %q", c.Uncited)
+	}
+}
+
+func TestResearch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	planned, report := `{"queries": ["where is waldo", "what does waldo wear"]}`, ""
+	ts := fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/generate":
+			req := CompletionRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			answer := "Waldo is hiding at the beach [1]. He wears a striped shirt [2]."
+			if strings.HasPrefix(req.Prompt, "You are planning") {
+				answer = planned
+			} else if strings.HasPrefix(req.Prompt, "You are researching") {
+				answer = `{"done": true}`
+			} else {
+				report = req.System
+			}
+			json.NewEncoder(w).Encode(CompletionResponse{Response: answer})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		default:
+			w.Write([]byte(`<html><body><p>Waldo was last seen at ` + r.URL.Path + `</p></body></html>`))
+		}
+	})
+	file := t.TempDir() + "/fixture.json"
+	os.WriteFile(file, []byte(`{
+		"where is waldo": [{"title": "Beach", "info": "waldo at the beach", "url": "`+ts.URL+`/beach"}],
+		"what does waldo wear": [{"title": "Shirts", "info": "striped shirts", "url": "`+ts.URL+`/shirts"}]
+	}`), 0o644)
+	cfg.Search.Fixture.File = file
+	defer func() { cfg.Search = defaultConfig().Search }()
+
+	statuses := []string{}
+	out := &strings.Builder{}
+	r, err := research(context.Background(), &WriterSink{W: out}, "waldo-research", "where is waldo?", SearchOptions{Engine: "fixture"}, func(s string) {
+		statuses = append(statuses, s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(r.Queries) != "[where is waldo what does waldo wear]" || len(r.Sources) != 2 {
+		t.Errorf("unexpected queries %q and sources %+v", r.Queries, r.Sources)
+	}
+	if r.Sources[0].Text != "Waldo was last seen at /beach" {
+		t.Errorf("page not read, text is %q", r.Sources[0].Text)
+	}
+	if !strings.Contains(out.String(), "[2] Shirts") {
+		t.Errorf("sources missing from report %q", out.String())
+	}
+	md := r.Markdown()
+	if !strings.HasPrefix(md, "# where is waldo?") || !strings.Contains(md, "- [1] [Beach]("+ts.URL+"/beach)") {
+		t.Errorf("unexpected markdown %q", md)
+	}
+	if len(statuses) == 0 {
+		t.Errorf("no progress reported")
+	}
+	given := struct {
+		Question string   `json:"question"`
+		Queries  []string `json:"queries"`
+	}{}
+	err = json.Unmarshal([]byte(report), &given)
+	if err != nil || given.Question != "where is waldo?" || len(given.Queries) != 2 {
+		t.Errorf("unexpected report context %s, %v", report, err)
+	}
+
+	// the question is searched even if the model is done before searching
+	planned = `{"done": true}`
+	r, err = research(context.Background(), &FuncSink{}, "waldo-research", "where is waldo", SearchOptions{Engine: "fixture"}, func(string) {})
+	if err != nil || fmt.Sprint(r.Queries) != "[where is waldo]" || len(r.Sources) != 1 {
+		t.Errorf("expected the question to be searched, got %+v, %v", r, err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	searches := 0
+	engine := &FuncEngine{func(query string) []SearchResult {
+		searches++
+		return []SearchResult{{"Waldo", "where is waldo", "https://example.com"}}
+	}}
+	opts := SearchOptions{}
+	for i := 0; i < 2; i++ {
+		results, err := cachedSearch(context.Background(), engine, "Where is  Waldo", opts)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("unexpected results %+v, %v", results, err)
+		}
+	}
+	cachedSearch(context.Background(), engine, "where is waldo", opts)
+	if searches != 1 {
+		t.Errorf("searched %d times, expected 1", searches)
+	}
+	opts.Fresh = true
+	cachedSearch(context.Background(), engine, "where is waldo", opts)
+	if searches != 2 {
+		t.Errorf("fresh search did not search")
+	}
+
+	entries, err := listCache()
+	if err != nil || len(entries) != 1 || entries[0].Key != "func: where is waldo" {
+		t.Fatalf("unexpected cache entries %v, %v", entries, err)
+	}
+	n, err := purgeCache(func(e *CacheEntry) bool { return e.Expired() })
+	if err != nil || n != 0 {
+		t.Errorf("purged %d entries that have not expired", n)
+	}
+	n, _ = purgeCache(func(e *CacheEntry) bool { return true })
+	if n != 1 {
+		t.Errorf("purged %d entries, expected 1", n)
+	}
+}
+
+// FuncEngine is a search engine that calls a function
+type FuncEngine struct {
+	search func(query string) []SearchResult
+}
+
+func (e *FuncEngine) Name() string {
+	return "func"
+}
+
+func (e *FuncEngine) Search(c context.Context, query string, opts SearchOptions) ([]SearchResult, error) {
+	return e.search(query), nil
+}
+
+func TestDocs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var ctx string
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/embeddings":
+			req := EmbeddingRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			vector := []float64{0, 0, 0.1}
+			if strings.Contains(req.Prompt, "shirt") {
+				vector[0] = 1
+			}
+			if strings.Contains(req.Prompt, "beach") {
+				vector[1] = 1
+			}
+			json.NewEncoder(w).Encode(EmbeddingResponse{Embedding: vector})
+		case "/api/generate":
+			req := CompletionRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			ctx = req.System
+			json.NewEncoder(w).Encode(CompletionResponse{Response: "Waldo wears a red and white striped shirt [1]."})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+	cfg.Docs.ChunkSize = 40
+	defer func() { cfg.Docs = defaultConfig().Docs }()
+
+	embeddings := 0
+	dir := t.TempDir()
+	os.WriteFile(dir+"/waldo.md", []byte("# Waldo\n\nWaldo is at the beach.\n\nHe wears a red and white striped shirt.\n"), 0o644)
+	os.WriteFile(dir+"/odlaw.md", []byte("---\ntags: [villain]\n---\nOdlaw wears a yellow and black striped shirt.\n"), 0o644)
+	os.WriteFile(dir+"/image.png", []byte("not indexed"), 0o644)
+	store, stats, err := indexDocs(context.Background(), dir, func(string) { embeddings++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := store.Documents[dir+"/waldo.md"].Chunks
+	if stats.Added != 2 || len(chunks) != 2 || chunks[1].StartLine != 5 || chunks[1].EndLine != 5 {
+		t.Fatalf("unexpected update %s with chunks %+v", stats, chunks)
+	}
+	if tags := store.Documents[dir+"/odlaw.md"].Tags; fmt.Sprint(tags) != "[villain]" {
+		t.Errorf("tags are %v, expected [villain]", tags)
+	}
+
+	// only changed documents are indexed again
+	os.WriteFile(dir+"/waldo.md", []byte("# Waldo\n\nWaldo is at the beach.\n\nHe wears a red and white striped shirt.\n"), 0o644)
+	os.Remove(dir + "/odlaw.md")
+	_, stats, err = indexDocs(context.Background(), dir, func(string) { embeddings++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.String() != "0 added, 0 updated, 1 unchanged, 1 removed" || embeddings != 2 {
+		t.Errorf("unexpected update %s after %d documents embedded", stats, embeddings)
+	}
+
+	out := &strings.Builder{}
+	_, err = docs(context.Background(), &WriterSink{W: out}, "waldo-docs", "what shirt does waldo wear?", Filter{Path: "*.md", Type: "md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "[1] waldo.md:5\n") {
+		t.Errorf("expected a citation of waldo.md:5 in %q", out.String())
+	}
+	// the query and documents are given to the model as JSON
+	given := map[string]string{}
+	err = json.Unmarshal([]byte(ctx), &given)
+	if err != nil || given["query"] != "what shirt does waldo wear?" || !strings.Contains(given["documents"], "File: waldo.md:5") {
+		t.Errorf("unexpected context %s, %v", ctx, err)
+	}
+	os.WriteFile(dir+"/quoted.md", []byte("Wenda said \"the shirt\\ is striped\".\n"), 0o644)
+	indexDocs(context.Background(), dir, func(string) {})
+	_, err = docs(context.Background(), &WriterSink{W: out}, "waldo-docs", `which "shirt"?`, Filter{})
+	if err == nil {
+		err = json.Unmarshal([]byte(ctx), &given)
+	}
+	if err != nil || given["query"] != `which "shirt"?` || !strings.Contains(given["documents"], `Wenda said "the shirt\ is striped".`) {
+		t.Errorf("unexpected context %s, %v", ctx, err)
+	}
+	_, err = docs(context.Background(), &WriterSink{W: out}, "waldo-docs", "what shirt does waldo wear?", Filter{Tags: []string{"villain"}})
+	if err == nil {
+		t.Errorf("expected an error as no documents have the tag")
+	}
+}
+
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// a PDF file with the objects, numbered from 1, the first is the catalog
+func pdfFile(objects ...string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, object := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<</Size %d/Root 1 0 R>>\nstartxref\n%d\n%%%%EOF", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	docx := zipFiles(t, map[string]string{
+		"word/document.xml": `<w:document xmlns:w="w"><w:body>
+<w:p><w:r><w:t>Where is Waldo?</w:t></w:r></w:p>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Clothes</w:t></w:r></w:p>
+<w:p><w:r><w:instrText>PAGE</w:instrText><w:t>Waldo wears a </w:t></w:r><w:r><w:t>striped shirt.</w:t></w:r></w:p>
+</w:body></w:document>`,
+	})
+	sections, err := extractDocument("waldo.docx", docx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 2 || sections[0].Name != "" || sections[1].Name != "Clothes" ||
+		sections[1].Text != "Clothes\nWaldo wears a striped shirt.\n" {
+		t.Errorf("unexpected DOCX sections %q", sections)
+	}
+
+	epub := zipFiles(t, map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="OEBPS/content.opf"/></rootfiles></container>`,
+		"OEBPS/content.opf": `<package><manifest>
+<item id="c1" href="one.xhtml"/><item id="c2" href="text/two.xhtml"/>
+</manifest><spine><itemref idref="c2"/><itemref idref="c1"/></spine></package>`,
+		"OEBPS/one.xhtml":      `<html><body><h1>The Beach</h1><p>Waldo is on the beach.</p></body></html>`,
+		"OEBPS/text/two.xhtml": `<html><body><h1>The Town</h1><p>Waldo is in town.</p></body></html>`,
+	})
+	sections, err = extractDocument("waldo.epub", epub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 2 || sections[0].Name != "chapter 1: The Town" || sections[1].Name != "chapter 2: The Beach" ||
+		!strings.Contains(sections[1].Text, "Waldo is on the beach.") {
+		t.Errorf("unexpected EPUB sections %q", sections)
+	}
+
+	// chunks of a document with sections are cited by section
+	chunks := chunkSections(sections, 1000)
+	m := Match{Document: &Document{Root: "/books", Path: "/books/waldo.epub"}, Chunk: chunks[1]}
+	if len(chunks) != 2 || m.Location() != "waldo.epub, chapter 2: The Beach" {
+		t.Errorf("unexpected chunks %v, location %s", chunks, m.Location())
+	}
+
+	_, err = extractDocument("waldo.pdf", []byte("not a pdf"))
+	if err == nil {
+		t.Errorf("expected an error for an invalid PDF")
+	}
+
+	// each page has its own fonts, with the same names
+	pdf := pdfFile(
+		"<</Type/Catalog/Pages 2 0 R>>",
+		"<</Type/Pages/Kids[3 0 R 4 0 R]/Count 2>>",
+		"<</Type/Page/Parent 2 0 R/Resources<</Font<</F1 6 0 R>>>>/Contents 5 0 R>>",
+		"<</Type/Page/Parent 2 0 R/Resources<</Font<</F1 7 0 R>>>>/Contents 5 0 R>>",
+		"<</Length 25>>\nstream\nBT /F1 12 Tf (wally) Tj ET\nendstream",
+		"<</Type/Font/Subtype/Type1/BaseFont/Helvetica>>",
+		"<</Type/Font/Subtype/Type1/BaseFont/Helvetica/Encoding<</Differences[119/o/d]>>>>",
+	)
+	sections, err = extractDocument("waldo.pdf", pdf)
+	if err != nil || len(sections) != 2 || sections[0].Name != "page 1" || sections[0].Text != "wally" ||
+		sections[1].Name != "page 2" || sections[1].Text != "oally" {
+		t.Errorf("unexpected PDF sections %q, %v", sections, err)
+	}
+
+	// malformed PDFs are errors and do not crash
+	pdf = pdfFile(
+		"<</Type/Catalog/Pages 2 0 R>>",
+		"<</Type/Pages/Kids[3 0 R]/Count 1>>",
+		"<</Type/Page/Parent 2 0 R/Resources<</Font<</F1 5 0 R>>>>/Contents 4 0 R>>",
+		"<</Length 25>>\nstream\nBT /F1 12 Tf (wally) Tj ET\nendstream",
+		"<</Type/Font/Subtype /Type1 /BaseFont (Helv",
+	)
+	_, err = extractDocument("waldo.pdf", pdf)
+	if err == nil {
+		t.Errorf("expected an error for a malformed PDF")
+	}
+
+	// each attached file gets a share of the characters
+	dir := t.TempDir()
+	long := []string{filepath.Join(dir, "waldo.txt"), filepath.Join(dir, "wenda.txt")}
+	os.WriteFile(long[0], []byte(strings.Repeat("waldo ", 200)), 0o644)
+	os.WriteFile(long[1], []byte(strings.Repeat("wenda ", 200)), 0o644)
+	formatted, err := formatFiles(long, 400)
+	if err != nil || !strings.Contains(formatted, "[waldo.txt]") || !strings.Contains(formatted, "[wenda.txt]\nwenda") ||
+		len(formatted) > 420 {
+		t.Errorf("unexpected files %q, %v", formatted, err)
+	}
+
+	// attached files are given to the model with the question
+	file := filepath.Join(dir, "waldo.docx")
+	os.WriteFile(file, docx, 0o644)
+	var prompt string
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/chat":
+			req := ChatRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			prompt = req.Messages[len(req.Messages)-1].Content
+			json.NewEncoder(w).Encode(CompletionResponse{Response: "A striped shirt [waldo.docx, Clothes]."})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+	s := newSession()
+	_, err = ask(context.Background(), &WriterSink{W: &strings.Builder{}}, s, "waldo-files", "what does waldo wear?", []string{file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt, "[waldo.docx, Clothes]\nClothes\nWaldo wears a striped shirt.") ||
+		!strings.HasSuffix(prompt, "Waldo wears a striped shirt.\n\nQuestion: what does waldo wear?") {
+		t.Errorf("unexpected prompt %s", prompt)
+	}
+	if len(s.Turns) != 1 || s.Turns[0].Prompt != "what does waldo wear?" || len(s.Turns[0].Files) != 1 {
+		t.Errorf("unexpected turns %v", s.Turns)
+	}
+}
+
+func TestProposeCommand(t *testing.T) {
+	answer, ctx := "", ""
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/generate":
+			req := CompletionRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.Format != "json" {
+				t.Errorf("expected a JSON request, got %q", req.Format)
+			}
+			ctx = req.System
+			json.NewEncoder(w).Encode(CompletionResponse{Response: answer})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+
+	answer = `{"inputs": [], "command": "echo waldo", "outputs": ["waldo"], "explanation": "Prints waldo.", "risk": "Low"}`
+	resp, err := proposeCommand(context.Background(), "waldo-do", "print waldo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Command != "echo waldo" || resp.Risk != riskLow || resp.Explanation != "Prints waldo." {
+		t.Errorf("unexpected command %+v", resp)
+	}
+	out, err := runCommand(context.Background(), resp, func(string) bool { return true }, io.Discard, io.Discard)
+	if err != nil || string(out) != "waldo\n" {
+		t.Errorf("unexpected output %q, %v", out, err)
+	}
+
+	// commands that are not rated are taken as risky
+	answer = `{"command": "rm -rf build"}`
+	resp, err = proposeCommand(context.Background(), "waldo-do", "clean up")
+	if err != nil || resp.Risk != riskHigh {
+		t.Errorf("expected a high risk command, got %+v, %v", resp, err)
+	}
+
+	// the task is given to the model as it was typed
+	task := "replace \"waldo\" with\n'wenda' in *.txt"
+	proposeCommand(context.Background(), "waldo-do", task)
+	given := map[string]string{}
+	err = json.Unmarshal([]byte(ctx), &given)
+	if err != nil || given["task"] != task || given["shell"] != "bash" {
+		t.Errorf("unexpected context %s, %v", ctx, err)
+	}
+
+	answer = `{"command": ""}`
+	_, err = proposeCommand(context.Background(), "waldo-do", "do nothing")
+	if err == nil {
+		t.Errorf("expected an error when no command is proposed")
+	}
+
+	if !confirmed(" Y\n") || confirmed("") || confirmed("no") {
+		t.Errorf("unexpected confirmation")
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	defer func() { cfg.Shell = defaultConfig().Shell }()
+	never := func(string) bool { return false }
+	tests := []struct {
+		profile string
+		line    string
+		confirm bool
+		denied  bool
+	}{
+		{"default", "ls -al", false, false},
+		{"default", "rm notes.txt", true, false},
+		{"default", "rm -rf /", false, true},
+		{"default", "sudo   rm -fr ~/", false, true},
+		{"default", `rm -rf "$HOME"`, false, true},
+		{"default", "rm -r -f '/'", false, true},
+		{"default", "rm --recursive --force ~", false, true},
+		{"default", `rm -rf "$HOME"/*`, false, true},
+		{"default", "rm -R ~/*", false, true},
+		{"default", "rm -rf ~/build", true, false},
+		{"default", "find . -name '*.tmp' | xargs rm", true, false},
+		{"default", "git push origin main", true, false},
+		{"strict", "ls -al | grep go 2>&1 && LANG=C wc -l *.go", false, false},
+		{"strict", "cd /tmp && echo $(pwd)", false, false},
+		{"strict", "ls; curl example.com", false, true},
+		{"strict", "/usr/bin/python3 -V", false, true},
+		{"strict", "echo 'unclosed", false, true},
+	}
+	for _, tt := range tests {
+		cfg.Shell.Profile = tt.profile
+		policy, err := commandPolicy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		confirm, err := policy.Check(tt.line)
+		if confirm != tt.confirm || (err != nil) != tt.denied {
+			t.Errorf("%s with %s: expected confirm %v denied %v, got %v %v", tt.line, tt.profile, tt.confirm, tt.denied, confirm, err)
+		}
+	}
+
+	// the root and home directories are denied once expanded too
+	cfg.Shell.Profile = "default"
+	policy, _ := commandPolicy()
+	home, _ := os.UserHomeDir()
+	for _, args := range [][]string{
+		{"rm", "-rf", home}, {"rm", "-rf", home + "/"}, {"/bin/rm", "-r", "/home/.."},
+		{"rm", "--recursive", "--force", home}, {"rm", "-R", "/usr"},
+		// globs like "$HOME"/* are expanded to the files in the directory
+		{"rm", "-rf", filepath.Join(home, ".bashrc"), filepath.Join(home, "src")},
+		{"rm", "-rf", "src"},
+	} {
+		if err := policy.CheckProgram(home, args); err == nil {
+			t.Errorf("expected %v to be denied", args)
+		}
+	}
+	for _, args := range [][]string{
+		{"rm", "-rf", filepath.Join(home, "src", "build")}, {"rm", "-rf", "build"}, {"rm", filepath.Join(home, "notes.txt")},
+	} {
+		if err := policy.CheckProgram(filepath.Join(home, "src"), args); err != nil {
+			t.Errorf("expected %v to be run, got %v", args, err)
+		}
+	}
+
+	// commands to be confirmed are not run unless confirmed
+	dir := t.TempDir()
+	file := filepath.Join(dir, "waldo.txt")
+	os.WriteFile(file, []byte("waldo"), 0o644)
+	_, err := run(context.Background(), "rm "+file, never, io.Discard, io.Discard)
+	if _, statErr := os.Stat(file); err == nil || statErr != nil {
+		t.Errorf("expected the file not to be removed, got %v", err)
+	}
+
+	// and not when they are only known once the command line is expanded
+	for _, line := range []string{"x=r; ${x}m " + file, "x=r; eval \"${x}m " + file + "\"", "$(echo r)m " + file} {
+		_, err = run(context.Background(), line, never, io.Discard, io.Discard)
+		if status, ok := interp.IsExitStatus(err); !ok || status != 126 {
+			t.Errorf("expected %s not to be run, got %v", line, err)
+		}
+		if _, statErr := os.Stat(file); statErr != nil {
+			t.Errorf("expected the file not to be removed by %s", line)
+		}
+	}
+	// nor without a way to confirm them
+	cmd, _ := parseCommand("x=r; ${x}m " + file)
+	_, err = sh.Run(context.Background(), cmd, io.Discard, io.Discard)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 126 {
+		t.Errorf("expected the command not to be run without confirming, got %v", err)
+	}
+	other := filepath.Join(dir, "wenda.txt")
+	os.WriteFile(other, []byte("wenda"), 0o644)
+	asked := []string{}
+	_, err = run(context.Background(), "x=r; ${x}m "+other, func(line string) bool {
+		asked = append(asked, line)
+		return true
+	}, io.Discard, io.Discard)
+	if _, statErr := os.Stat(other); err != nil || statErr == nil || len(asked) != 1 || asked[0] != "rm "+other {
+		t.Errorf("expected the expanded command to be confirmed and run, got %v %q", err, asked)
+	}
+
+	// programs are checked again once the command line is expanded
+	_, err = run(context.Background(), "X=/; rm -rf $X", func(string) bool { return true }, io.Discard, io.Discard)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 126 {
+		t.Errorf("expected the expanded command to be denied, got %v", err)
+	}
+
+	// dry runs do not run anything
+	cfg.Shell.Profile = "dry-run"
+	out, err := run(context.Background(), "rm "+file, never, io.Discard, io.Discard)
+	if _, statErr := os.Stat(file); err != nil || len(out) != 0 || statErr != nil {
+		t.Errorf("expected a dry run, got %q %v", out, err)
+	}
+
+	cfg.Shell.Profile = "reckless"
+	_, err = run(context.Background(), "ls", never, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "default, dry-run, strict") {
+		t.Errorf("expected an error for an unknown profile, got %v", err)
+	}
+}
+
+func TestShell(t *testing.T) {
+	// start a new shell, and do not leave it in a directory that is removed
+	sh = nil
+	defer func() { sh = nil }()
+	dir := t.TempDir()
+	always := func(string) bool { return true }
+	lines := []struct {
+		line string
+		out  string
+	}{
+		// the working directory and variables are kept between lines
+		{"cd " + dir, ""},
+		{"export WHO='waldo and wenda'", ""},
+		{`echo "$WHO" > who.txt; echo odlaw >> who.txt`, ""},
+		{"cat who.txt | grep -c w", "2\n"},
+		{"touch a.md b.md && ls *.md", "a.md\nb.md\n"},
+		{"GREETING=hi sh -c 'echo $GREETING' && pwd", "hi\n" + dir + "\n"},
+		{"echo 'quoted   spaces' 1>&2", "quoted   spaces\n"},
+	}
+	for _, l := range lines {
+		out, err := run(context.Background(), l.line, always, io.Discard, io.Discard)
+		if err != nil || string(out) != l.out {
+			t.Errorf("%s: expected %q, got %q %v", l.line, l.out, out, err)
+		}
+	}
+	if sh.Dir() != dir {
+		t.Errorf("expected the shell to be in %s, not %s", dir, sh.Dir())
+	}
+	_, err := run(context.Background(), "false", always, io.Discard, io.Discard)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 1 {
+		t.Errorf("expected exit status 1, got %v", err)
+	}
+}
+
+func TestRunStreaming(t *testing.T) {
+	sh = nil
+	defer func() { cfg.Timeouts = defaultConfig().Timeouts }()
+	always := func(string) bool { return true }
+
+	// the output is written as the command runs, not when it is done
+	stdout, stderr := &lockedBuffer{}, &lockedBuffer{}
+	done := make(chan error)
+	go func() {
+		_, err := run(context.Background(), "echo waldo; echo odlaw >&2; sleep 0.5; echo wenda", always, stdout, stderr)
+		done <- err
+	}()
+	time.Sleep(250 * time.Millisecond)
+	if string(stdout.Bytes()) != "waldo\n" || !strings.HasSuffix(string(stderr.Bytes()), "odlaw\n") {
+		t.Errorf("expected the output so far, got %q and %q", stdout.Bytes(), stderr.Bytes())
+	}
+	if err := <-done; err != nil || string(stdout.Bytes()) != "waldo\nwenda\n" {
+		t.Errorf("unexpected output %q, %v", stdout.Bytes(), err)
+	}
+	// the command and its exit status are reported to the error output
+	if lines := strings.Split(string(stderr.Bytes()), "\n"); !strings.Contains(lines[0], "executing>") ||
+		!strings.HasPrefix(lines[2], "(exit status 0") {
+		t.Errorf("expected the command and exit status in the error output, got %q", stderr.Bytes())
+	}
+
+	// cancelling stops the program and the processes it started
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	_, err := run(ctx, "sh -c 'sleep 5; echo too late'", always, io.Discard, io.Discard)
+	if err == nil || time.Since(t0) > killTimeout {
+		t.Errorf("expected the command to be stopped, got %v after %s", err, time.Since(t0))
+	}
+
+	cfg.Timeouts.Command = 200 * time.Millisecond
+	t0 = time.Now()
+	_, err = run(context.Background(), "sleep 5", always, io.Discard, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "timed out") || time.Since(t0) > killTimeout {
+		t.Errorf("expected the command to time out, got %v after %s", err, time.Since(t0))
+	}
+
+	_, err = run(context.Background(), "exit 3", always, io.Discard, io.Discard)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+}
+
+func TestDiagnoseCommand(t *testing.T) {
+	var ctx string
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/generate":
+			req := CompletionRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			ctx = req.System
+			json.NewEncoder(w).Encode(CompletionResponse{Response: `{"explanation": "There is no file called waldo.og.", "command": "cat waldo.go", "risk": "low"}`})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+
+	output := ""
+	for i := 1; i <= 60; i++ {
+		output += fmt.Sprintf("line %d\n", i)
+	}
+	output += "cat: \"waldo.og\": No such file or directory\n"
+	resp, err := diagnoseCommand(context.Background(), "waldo-diagnose", "cat waldo.og", 1, []byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Command != "cat waldo.go" || resp.Risk != riskLow || resp.Explanation != "There is no file called waldo.og." {
+		t.Errorf("unexpected diagnosis %+v", resp)
+	}
+	// only the end of the output is given to the model
+	given := struct {
+		Command    string `json:"command"`
+		ExitStatus int    `json:"exit_status"`
+		Output     string `json:"output"`
+	}{}
+	err = json.Unmarshal([]byte(ctx), &given)
+	if err != nil || given.Command != "cat waldo.og" || given.ExitStatus != 1 ||
+		!strings.HasPrefix(given.Output, "line 12\nline 13\n") ||
+		!strings.HasSuffix(given.Output, `cat: "waldo.og": No such file or directory`) {
+		t.Errorf("unexpected context %s, %v", ctx, err)
+	}
+}
+
+func TestAskShellOutput(t *testing.T) {
+	sh = nil
+	defer func() { sh = nil }()
+	_, err := run(context.Background(), "for i in $(seq 1 500); do echo \"line $i\"; done; echo 'FAIL: TestWaldo' >&2; exit 1",
+		func(string) bool { return true }, io.Discard, io.Discard)
+	if status, ok := interp.IsExitStatus(err); !ok || status != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if sh.Last == nil || sh.Last.Status != 1 || !strings.HasSuffix(sh.Last.Output, "line 500\nFAIL: TestWaldo\n") {
+		t.Fatalf("unexpected last output %+v", sh.Last)
+	}
+
+	// long output keeps whole lines from the start and more from the end
+	text := truncateOutput(sh.Last.Output, 400)
+	if len(text) > 450 || !strings.HasPrefix(text, "line 1\nline 2\n") || !strings.HasSuffix(text, "line 500\nFAIL: TestWaldo") ||
+		!strings.Contains(text, " lines left out ...]\n") {
+		t.Errorf("unexpected truncated output %q", text)
+	}
+	if stripANSI("\x1b[31mFAIL\x1b[0m") != "FAIL" {
+		t.Errorf("expected the colors to be removed")
+	}
+	for line, args := range map[string][]string{
+		`grep -r 'where is waldo' '*.go'`: {"grep", "-r", "where is waldo", "*.go"},
+		`echo '$HOME'`:                    {"echo", "$HOME"},
+		`echo 'waldo;' '' 'a|b' "it's"`:   {"echo", "waldo;", "", "a|b", "it's"},
+		`ls -la ./waldo_test.go`:          {"ls", "-la", "./waldo_test.go"},
+	} {
+		if shellWords(args) != line {
+			t.Errorf("unexpected command line %s, expected %s", shellWords(args), line)
+		}
+	}
+
+	var prompt string
+	fakeOllama(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/show":
+			w.Write([]byte(`{}`))
+		case "/api/chat":
+			req := ChatRequest{}
+			json.NewDecoder(r.Body).Decode(&req)
+			prompt = req.Messages[len(req.Messages)-1].Content
+			json.NewEncoder(w).Encode(CompletionResponse{Response: "TestWaldo failed."})
+			json.NewEncoder(w).Encode(CompletionResponse{Done: true})
+		}
+	})
+	s := newSession()
+	_, err = ask(context.Background(), &WriterSink{W: &strings.Builder{}}, s, "waldo-output", "which test failed?", nil, sh.Last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt, "$ for i in") || !strings.Contains(prompt, "line 500\nFAIL: TestWaldo\n(exit status 1)") ||
+		!strings.HasSuffix(prompt, "(exit status 1)\n\nQuestion: which test failed?") {
+		t.Errorf("unexpected prompt %s", prompt)
+	}
+	if len(s.Turns) != 1 || !strings.HasPrefix(s.Turns[0].Command, "for i in") {
+		t.Errorf("unexpected turns %v", s.Turns)
+	}
+}
+
+// start a fake Ollama server with the handler, the config points to it until
+// the test is done
+func fakeOllama(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	old := cfg.Ollama.Host
+	cfg.Ollama.Host = strings.TrimPrefix(ts.URL, "http://")
+	t.Cleanup(func() {
+		cfg.Ollama.Host = old
+		ts.Close()
+	})
+	return ts
+}